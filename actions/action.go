@@ -6,17 +6,71 @@ import (
 
 	"github.com/mihaitodor/wormhole/config"
 	"github.com/mihaitodor/wormhole/transport"
+	"github.com/mihaitodor/wormhole/vars"
 	"github.com/mitchellh/mapstructure"
 )
 
 type Action interface {
 	setType(string)
 	GetType() string
-	Run(context.Context, transport.Connection, config.Config) error
+	GetBecome() BecomeSettings
+	InheritBecome(BecomeSettings)
+	// Run applies the action to the host behind the connection and reports
+	// whether anything changed
+	Run(context.Context, transport.Connection, config.Config, *vars.Scope) (Result, error)
+}
+
+// Checker is implemented by actions which can report whether they would
+// change the host without changing anything, for check mode. Actions which
+// don't implement it are skipped in check mode.
+type Checker interface {
+	Check(context.Context, transport.Connection, config.Config, *vars.Scope) (Result, error)
+}
+
+// shorthand is implemented by actions which can also be represented as
+// `key: string_value` in the playbook YAML. It returns the name of the field
+// which receives the string value.
+type shorthand interface {
+	shorthandField() string
+}
+
+// BecomeSettings holds the privilege escalation settings of a playbook, task
+// or action. The unset fields are inherited from the enclosing level.
+type BecomeSettings struct {
+	Become       *bool  `mapstructure:"become" yaml:"become"`
+	BecomeMethod string `mapstructure:"become_method" yaml:"become_method"`
+	BecomeUser   string `mapstructure:"become_user" yaml:"become_user"`
+}
+
+// Enabled returns true if commands need to run as a different user
+func (b BecomeSettings) Enabled() bool {
+	return b.Become != nil && *b.Become
+}
+
+// Inherit returns a copy of the settings with the unset fields populated
+// from parent
+func (b BecomeSettings) Inherit(parent BecomeSettings) BecomeSettings {
+	if b.Become == nil {
+		b.Become = parent.Become
+	}
+	if b.BecomeMethod == "" {
+		b.BecomeMethod = parent.BecomeMethod
+	}
+	if b.BecomeUser == "" {
+		b.BecomeUser = parent.BecomeUser
+	}
+
+	return b
+}
+
+// Validate checks if the become method is supported
+func (b BecomeSettings) Validate() error {
+	return transport.ValidateBecomeMethod(b.BecomeMethod)
 }
 
 type ActionBase struct {
-	Type string
+	Type           string
+	BecomeSettings `mapstructure:",squash"`
 }
 
 func (a *ActionBase) setType(t string) {
@@ -27,12 +81,22 @@ func (a *ActionBase) GetType() string {
 	return a.Type
 }
 
+func (a *ActionBase) GetBecome() BecomeSettings {
+	return a.BecomeSettings
+}
+
+func (a *ActionBase) InheritBecome(parent BecomeSettings) {
+	a.BecomeSettings = a.BecomeSettings.Inherit(parent)
+}
+
 func initAction(actionType string) (Action, error) {
 	var a Action
 
 	switch actionType {
 	case "file":
 		a = &FileAction{}
+	case "template":
+		a = &TemplateAction{}
 	case "apt":
 		a = &AptAction{}
 	case "service":
@@ -76,10 +140,15 @@ func UnmarshalAction(actionType string, rawAction interface{}) (Action, error) {
 		return nil, fmt.Errorf("failed to initialise action decoder: %s", err)
 	}
 
-	// Hack: We use the generic mapstructure tag "data" to decode actions which
-	// are represented as `key: value` instead of `key: map_of_values`.
+	// Actions which are represented as `key: value` instead of
+	// `key: map_of_values` receive the value in their shorthand field. The
+	// generic "data" field is only used for reporting errors for the others.
 	if str, ok := rawAction.(string); ok {
-		rawAction = map[string]string{"data": str}
+		field := "data"
+		if s, ok := action.(shorthand); ok {
+			field = s.shorthandField()
+		}
+		rawAction = map[string]string{field: str}
 	}
 
 	err = decoder.Decode(rawAction)
@@ -87,5 +156,10 @@ func UnmarshalAction(actionType string, rawAction interface{}) (Action, error) {
 		return nil, fmt.Errorf("failed to decode action: %s", err)
 	}
 
+	err = action.GetBecome().Validate()
+	if err != nil {
+		return nil, err
+	}
+
 	return action, nil
 }
@@ -38,6 +38,22 @@ func Test_UnmarshalAction(t *testing.T) {
 			So(action.(*ShellAction).Command, ShouldEqual, shellAction)
 		})
 
+		Convey("should decode shell actions with a command key", func() {
+			action, err := UnmarshalAction("shell", map[string]interface{}{
+				"command": "apachectl configtest",
+				"safe":    true,
+			})
+			So(err, ShouldBeNil)
+			So(action.(*ShellAction).Command, ShouldEqual, "apachectl configtest")
+			So(action.(*ShellAction).Safe, ShouldBeTrue)
+		})
+
+		Convey("should fail to decode other actions which are represented as `key: value`", func() {
+			_, err := UnmarshalAction("apt", "apache2")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "has invalid keys: data")
+		})
+
 		Convey("should decode actions which have duration fields", func() {
 			actionType := "validate"
 			timeout := 5 * time.Second
@@ -52,6 +68,33 @@ func Test_UnmarshalAction(t *testing.T) {
 			So(action.(*ValidateAction).Timeout, ShouldEqual, timeout)
 		})
 
+		Convey("should decode the become settings of actions", func() {
+			action, err := UnmarshalAction("service", map[string]interface{}{
+				"name":        "apache2",
+				"become":      true,
+				"become_user": "www-data",
+			})
+			So(err, ShouldBeNil)
+			So(action.GetBecome().Enabled(), ShouldBeTrue)
+			So(action.GetBecome().BecomeUser, ShouldEqual, "www-data")
+			So(action.(*ServiceAction).Name, ShouldEqual, "apache2")
+
+			Convey("and inherit the unset ones", func() {
+				action.InheritBecome(BecomeSettings{BecomeMethod: "su", BecomeUser: "root"})
+				So(action.GetBecome().BecomeMethod, ShouldEqual, "su")
+				So(action.GetBecome().BecomeUser, ShouldEqual, "www-data")
+			})
+		})
+
+		Convey("should fail to decode unrecognised become methods", func() {
+			_, err := UnmarshalAction("shell", map[string]interface{}{
+				"command":       "whoami",
+				"become_method": "doas",
+			})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "unrecognised become method: \"doas\"")
+		})
+
 		Convey("should fail to decode unrecognised actions", func() {
 			actionType := "foobar"
 
@@ -3,36 +3,112 @@ package actions
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/mihaitodor/wormhole/config"
 	"github.com/mihaitodor/wormhole/transport"
+	"github.com/mihaitodor/wormhole/vars"
 	"golang.org/x/sync/errgroup"
 )
 
 type AptAction struct {
-	ActionBase
-	State string   `mapstructure:"state"`
-	Pkg   []string `mapstructure:"pkg"`
+	ActionBase `mapstructure:",squash"`
+	State      string   `mapstructure:"state"`
+	Pkg        []string `mapstructure:"pkg"`
 }
 
-func (a *AptAction) Run(ctx context.Context, conn transport.Connection, _ config.Config) error {
+// Run skips the packages which are already installed, for the install state,
+// or not installed, for the remove and purge states. Other states, such as
+// upgrade, always run for all the packages.
+func (a *AptAction) Run(ctx context.Context, conn transport.Connection, _ config.Config, _ *vars.Scope) (Result, error) {
+	pkgs, err := a.pendingPackages(ctx, conn)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if len(pkgs) == 0 {
+		return resultFor(false), nil
+	}
+
 	// Update package lists first
-	err := conn.Exec(ctx, true, func(sess *transport.Session) (error, *errgroup.Group) {
+	_, err = conn.Exec(ctx, true, func(sess *transport.Session) (error, *errgroup.Group) {
 		return sess.Start("apt-get update"), nil
 	})
 	if err != nil {
-		return fmt.Errorf("failed to update package lists: %s", err)
+		return Result{}, fmt.Errorf("failed to update package lists: %s", err)
 	}
 
 	// Install the requested packages
-	for _, pkg := range a.Pkg {
-		err = conn.Exec(ctx, true, func(sess *transport.Session) (error, *errgroup.Group) {
+	for _, pkg := range pkgs {
+		_, err = conn.Exec(ctx, true, func(sess *transport.Session) (error, *errgroup.Group) {
 			return sess.Start(fmt.Sprintf("apt-get %s -y %s", a.State, pkg)), nil
 		})
 		if err != nil {
-			return fmt.Errorf("failed to install package %q: %s", pkg, err)
+			return Result{}, fmt.Errorf("failed to install package %q: %s", pkg, err)
 		}
 	}
 
-	return nil
+	return resultFor(true), nil
+}
+
+// Check reports the packages which are not in the requested state as changes
+func (a *AptAction) Check(ctx context.Context, conn transport.Connection, _ config.Config, _ *vars.Scope) (Result, error) {
+	pkgs, err := a.pendingPackages(ctx, conn)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return resultFor(len(pkgs) > 0), nil
+}
+
+// pendingPackages returns the packages which are not in the requested state
+func (a *AptAction) pendingPackages(ctx context.Context, conn transport.Connection) ([]string, error) {
+	if a.State != "install" && a.State != "remove" && a.State != "purge" {
+		return a.Pkg, nil
+	}
+
+	var pkgs []string
+	for _, pkg := range a.Pkg {
+		status, err := packageStatus(ctx, conn, pkg)
+		if err != nil {
+			return nil, err
+		}
+
+		pending := status != "installed"
+		switch a.State {
+		case "remove":
+			pending = status == "installed"
+		case "purge":
+			// Removed packages can still have config files
+			pending = status != "" && status != "not-installed"
+		}
+
+		if pending {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+
+	return pkgs, nil
+}
+
+// packageStatus returns the dpkg status of the package, such as `installed`
+// or `config-files`, or an empty string if dpkg doesn't know about it
+func packageStatus(ctx context.Context, conn transport.Connection, pkg string) (string, error) {
+	res, err := conn.Exec(ctx, true, func(sess *transport.Session) (error, *errgroup.Group) {
+		return sess.Start(fmt.Sprintf("dpkg-query -W -f='${Status}' %s", pkg)), nil
+	})
+	if _, ok := err.(*transport.ExitError); ok {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get the status of package %q: %s", pkg, err)
+	}
+
+	// The status looks like `install ok installed`
+	status := strings.Fields(res.Stdout)
+	if len(status) != 3 {
+		return "", nil
+	}
+
+	return status[2], nil
 }
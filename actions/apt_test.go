@@ -0,0 +1,136 @@
+package actions
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/mihaitodor/wormhole/config"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeDpkgQuery knows about an installed package (ring), a removed package
+// which still has config files (mithril) and a package which failed to
+// install (palantir)
+const fakeDpkgQuery = `# dpkg-query -W -f='${Status}' <package>
+case "$3" in
+ring) printf 'install ok installed' ;;
+mithril) printf 'deinstall ok config-files' ;;
+palantir) printf 'install reinstreq half-installed' ;;
+*) echo "dpkg-query: no packages found matching $3" >&2; exit 1 ;;
+esac
+`
+
+// fakeAptGet logs its arguments and fails for the balrog package
+const fakeAptGet = `# apt-get <command> [-y <package>]
+if [ "$3" = balrog ]; then
+	echo "E: Unable to locate package balrog" >&2
+	exit 100
+fi
+echo "$@" >> apt.log
+`
+
+func Test_AptAction(t *testing.T) {
+	Convey("AptAction.Run()", t, func(c C) {
+		server, conn := newTestConnection(c)
+		Reset(func() {
+			So(conn.Close(), ShouldBeNil)
+			So(server.Close(), ShouldBeNil)
+		})
+
+		So(server.AddCommand("dpkg-query", fakeDpkgQuery), ShouldBeNil)
+		So(server.AddCommand("apt-get", fakeAptGet), ShouldBeNil)
+
+		aptLog := func() string {
+			contents, _ := ioutil.ReadFile(filepath.Join(server.Root, "apt.log"))
+			return string(contents)
+		}
+
+		Convey("should install the packages which are not installed", func() {
+			action := AptAction{State: "install", Pkg: []string{"ring", "mithril", "palantir", "sting"}}
+			result, err := action.Run(context.Background(), conn, config.Config{}, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusChanged)
+			So(aptLog(), ShouldEqual, "update\ninstall -y mithril\ninstall -y palantir\ninstall -y sting\n")
+		})
+
+		Convey("should not change anything when the packages are installed", func() {
+			action := AptAction{State: "install", Pkg: []string{"ring"}}
+			result, err := action.Run(context.Background(), conn, config.Config{}, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusOK)
+			So(server.Commands(), ShouldResemble, []string{"dpkg-query -W -f='${Status}' ring"})
+		})
+
+		Convey("should only remove the installed packages", func() {
+			action := AptAction{State: "remove", Pkg: []string{"ring", "mithril", "sting"}}
+			result, err := action.Run(context.Background(), conn, config.Config{}, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusChanged)
+			So(aptLog(), ShouldEqual, "update\nremove -y ring\n")
+		})
+
+		Convey("should purge the packages which have config files", func() {
+			action := AptAction{State: "purge", Pkg: []string{"ring", "mithril", "sting"}}
+			result, err := action.Run(context.Background(), conn, config.Config{}, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusChanged)
+			So(aptLog(), ShouldEqual, "update\npurge -y ring\npurge -y mithril\n")
+		})
+
+		Convey("should always upgrade the packages", func() {
+			action := AptAction{State: "upgrade", Pkg: []string{"ring"}}
+			result, err := action.Run(context.Background(), conn, config.Config{}, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusChanged)
+			So(aptLog(), ShouldEqual, "update\nupgrade -y ring\n")
+		})
+
+		Convey("should return an error when a package fails to install", func() {
+			action := AptAction{State: "install", Pkg: []string{"balrog", "sting"}}
+			_, err := action.Run(context.Background(), conn, config.Config{}, nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, `failed to install package "balrog": command exited with status 100`)
+			So(err.Error(), ShouldContainSubstring, "Unable to locate package balrog")
+			So(aptLog(), ShouldEqual, "update\n")
+		})
+	})
+
+	Convey("AptAction.Check()", t, func(c C) {
+		server, conn := newTestConnection(c)
+		Reset(func() {
+			So(conn.Close(), ShouldBeNil)
+			So(server.Close(), ShouldBeNil)
+		})
+
+		So(server.AddCommand("dpkg-query", fakeDpkgQuery), ShouldBeNil)
+		So(server.AddCommand("apt-get", fakeAptGet), ShouldBeNil)
+
+		Convey("should report the packages which are not installed as changes", func() {
+			action := AptAction{State: "install", Pkg: []string{"ring", "sting"}}
+			result, err := action.Check(context.Background(), conn, config.Config{}, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusChanged)
+			So(server.Commands(), ShouldResemble, []string{
+				"dpkg-query -W -f='${Status}' ring",
+				"dpkg-query -W -f='${Status}' sting",
+			})
+		})
+
+		Convey("should report ok when the packages are in the requested state", func() {
+			action := AptAction{State: "remove", Pkg: []string{"mithril", "sting"}}
+			result, err := action.Check(context.Background(), conn, config.Config{}, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusOK)
+		})
+
+		Convey("should report upgrades as changes without running anything", func() {
+			action := AptAction{State: "upgrade", Pkg: []string{"ring"}}
+			result, err := action.Check(context.Background(), conn, config.Config{}, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusChanged)
+			So(server.Commands(), ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,220 @@
+package actions
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// maxDiffSize is the maximum size of the contents which are diffed
+	maxDiffSize = 32 * 1024
+	// maxDiffCells limits the size of the table used to find the longest
+	// common subsequence of the changed lines
+	maxDiffCells = 4 * 1024 * 1024
+	// diffContext is the number of unchanged lines around each change
+	diffContext = 3
+)
+
+// diffLine is a line of a diff, where kind is ' ', '-' or '+'
+type diffLine struct {
+	kind byte
+	text string
+}
+
+// isBinary checks if data contains a NUL byte within its first 8000 bytes,
+// like git does
+func isBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// unifiedDiff returns the changes between old and new in the unified
+// format, with the given file names in the header
+func unifiedDiff(oldName, newName string, old, new []byte) string {
+	lines := diffLines(splitLines(old), splitLines(new))
+
+	// oldPos and newPos hold the number of old and new lines before each
+	// line of the diff
+	oldPos := make([]int, len(lines)+1)
+	newPos := make([]int, len(lines)+1)
+	for i, line := range lines {
+		oldPos[i+1], newPos[i+1] = oldPos[i], newPos[i]
+		if line.kind != '+' {
+			oldPos[i+1]++
+		}
+		if line.kind != '-' {
+			newPos[i+1]++
+		}
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", oldName, newName)
+	for next := 0; next < len(lines); {
+		first := next
+		for first < len(lines) && lines[first].kind == ' ' {
+			first++
+		}
+		if first == len(lines) {
+			break
+		}
+
+		// Merge the changes which are separated by less than twice the
+		// context into the same hunk
+		end := first
+		for i := first; i < len(lines); i++ {
+			if lines[i].kind != ' ' {
+				end = i + 1
+			} else if i-end >= 2*diffContext {
+				break
+			}
+		}
+
+		start := first - diffContext
+		if start < next {
+			start = next
+		}
+		next = end + diffContext
+		if next > len(lines) {
+			next = len(lines)
+		}
+
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n",
+			hunkRange(oldPos[start], oldPos[next]-oldPos[start]),
+			hunkRange(newPos[start], newPos[next]-newPos[start]),
+		)
+		for _, line := range lines[start:next] {
+			buf.WriteByte(line.kind)
+			buf.WriteString(line.text)
+			if !strings.HasSuffix(line.text, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+
+	return buf.String()
+}
+
+// hunkRange formats the range of a hunk which starts after the line pos
+func hunkRange(pos, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", pos)
+	case 1:
+		return fmt.Sprintf("%d", pos+1)
+	default:
+		return fmt.Sprintf("%d,%d", pos+1, count)
+	}
+}
+
+// splitLines splits data into lines which keep their line endings
+func splitLines(data []byte) []string {
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
+
+// diffLines returns the edits which turn a into b. The common prefix and
+// suffix are skipped before comparing the rest of the lines.
+func diffLines(a, b []string) []diffLine {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var lines []diffLine
+	for _, text := range a[:prefix] {
+		lines = append(lines, diffLine{' ', text})
+	}
+	lines = append(lines, lcsDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, text := range a[len(a)-suffix:] {
+		lines = append(lines, diffLine{' ', text})
+	}
+
+	return lines
+}
+
+// lcsDiff returns the edits which turn a into b based on their longest
+// common subsequence. If a and b are too large, all the lines of a are
+// replaced with the lines of b instead.
+func lcsDiff(a, b []string) []diffLine {
+	var lines []diffLine
+	if len(a)*len(b) > maxDiffCells {
+		for _, text := range a {
+			lines = append(lines, diffLine{'-', text})
+		}
+		for _, text := range b {
+			lines = append(lines, diffLine{'+', text})
+		}
+		return lines
+	}
+
+	// lengths[i*(len(b)+1)+j] is the length of the longest common
+	// subsequence of a[i:] and b[j:]
+	width := len(b) + 1
+	lengths := make([]int, (len(a)+1)*width)
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lengths[i*width+j] = lengths[(i+1)*width+j+1] + 1
+			case lengths[(i+1)*width+j] >= lengths[i*width+j+1]:
+				lengths[i*width+j] = lengths[(i+1)*width+j]
+			default:
+				lengths[i*width+j] = lengths[i*width+j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i]})
+			i++
+			j++
+		case lengths[(i+1)*width+j] >= lengths[i*width+j+1]:
+			lines = append(lines, diffLine{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, diffLine{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, diffLine{'+', b[j]})
+	}
+
+	return lines
+}
+
+var (
+	// diffOutput receives the diffs printed in diff mode
+	diffOutput io.Writer = os.Stdout
+	diffMu     sync.Mutex
+)
+
+// printDiff writes the diff to diffOutput at once, so the diffs of different
+// hosts don't interleave
+func printDiff(diff string) {
+	diffMu.Lock()
+	defer diffMu.Unlock()
+
+	io.WriteString(diffOutput, diff)
+}
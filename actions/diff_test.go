@@ -0,0 +1,64 @@
+package actions
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_unifiedDiff(t *testing.T) {
+	Convey("unifiedDiff()", t, func() {
+		Convey("should show the changed lines with context", func() {
+			old := "one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\n"
+			new := "one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\n"
+			new = strings.Replace(new, "two\n", "2\n", 1)
+			new = strings.Replace(new, "nine\n", "nine\nnine and a half\n", 1)
+
+			So(unifiedDiff("a.txt", "b.txt", []byte(old), []byte(new)), ShouldEqual, ""+
+				"--- a.txt\n"+
+				"+++ b.txt\n"+
+				"@@ -1,5 +1,5 @@\n"+
+				" one\n"+
+				"-two\n"+
+				"+2\n"+
+				" three\n"+
+				" four\n"+
+				" five\n"+
+				"@@ -7,4 +7,5 @@\n"+
+				" seven\n"+
+				" eight\n"+
+				" nine\n"+
+				"+nine and a half\n"+
+				" ten\n",
+			)
+		})
+
+		Convey("should diff new files against an empty file", func() {
+			So(unifiedDiff("/dev/null", "b.txt", nil, []byte("ring\n")), ShouldEqual, ""+
+				"--- /dev/null\n"+
+				"+++ b.txt\n"+
+				"@@ -0,0 +1 @@\n"+
+				"+ring\n",
+			)
+		})
+
+		Convey("should mark missing newlines at the end of the file", func() {
+			So(unifiedDiff("a.txt", "b.txt", []byte("ring"), []byte("ring\n")), ShouldEqual, ""+
+				"--- a.txt\n"+
+				"+++ b.txt\n"+
+				"@@ -1 +1 @@\n"+
+				"-ring\n"+
+				"\\ No newline at end of file\n"+
+				"+ring\n",
+			)
+		})
+	})
+}
+
+func Test_isBinary(t *testing.T) {
+	Convey("isBinary()", t, func() {
+		So(isBinary([]byte("one ring\n")), ShouldBeFalse)
+		So(isBinary([]byte("one\x00ring")), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,42 @@
+package actions
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mihaitodor/wormhole/transport"
+	"github.com/mihaitodor/wormhole/vars"
+	"golang.org/x/sync/errgroup"
+)
+
+// gatherFactsCommand prints the facts of the host as `name=value` lines
+const gatherFactsCommand = `echo "hostname=$(hostname)"
+echo "os=$(uname -s)"
+echo "kernel=$(uname -r)"
+echo "arch=$(uname -m)"
+echo "user=$(id -un)"
+if [ -r /etc/os-release ]; then
+	(. /etc/os-release; echo "distribution=$ID"; echo "distribution_version=$VERSION_ID")
+fi`
+
+// GatherFacts collects information about the host, such as its hostname,
+// operating system and distribution
+func GatherFacts(ctx context.Context, conn transport.Connection) (vars.Vars, error) {
+	res, err := conn.Exec(ctx, false, func(sess *transport.Session) (error, *errgroup.Group) {
+		return sess.Start(gatherFactsCommand), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to gather facts: %s", err)
+	}
+
+	facts := make(vars.Vars)
+	for _, line := range strings.Split(res.Stdout, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(parts) == 2 {
+			facts[parts[0]] = parts[1]
+		}
+	}
+
+	return facts, nil
+}
@@ -1,106 +1,323 @@
 package actions
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"os"
+	"io/ioutil"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/mihaitodor/wormhole/config"
 	"github.com/mihaitodor/wormhole/transport"
-	log "github.com/sirupsen/logrus"
+	"github.com/mihaitodor/wormhole/vars"
 	"golang.org/x/sync/errgroup"
 )
 
 type FileAction struct {
-	ActionBase
-	Src   string `mapstructure:"src"`
-	Dest  string `mapstructure:"dest"`
-	Owner string `mapstructure:"owner"`
-	Group string `mapstructure:"group"`
-	Mode  string `mapstructure:"mode"`
+	ActionBase `mapstructure:",squash"`
+	Src        string `mapstructure:"src"`
+	Dest       string `mapstructure:"dest"`
+	Owner      string `mapstructure:"owner"`
+	Group      string `mapstructure:"group"`
+	Mode       string `mapstructure:"mode"`
 }
 
-// Copies the contents of src to dest on a remote host
-func copyFile(sess *transport.Session, src io.Reader, size int64, dest, mode string) error {
-	// Instruct the remote scp process that we want to bail out immediately
-	defer func() {
-		err := sess.CloseStdin()
-		if err != nil {
-			log.Warnf("Failed to close session stdin: %s", err)
-		}
-	}()
+// remoteFile holds the state of the destination file on the host
+type remoteFile struct {
+	exists   bool
+	owner    string
+	group    string
+	mode     string
+	size     int64
+	checksum string
+}
 
-	_, err := fmt.Fprintln(sess.Stdin(), "C"+mode, size, filepath.Base(dest))
-	if err != nil {
-		return fmt.Errorf("failed to create remote file: %s", err)
-	}
+// fileChanges are the steps needed to bring Dest to the requested state
+type fileChanges struct {
+	current remoteFile
+	copy    bool
+	chmod   bool
+	chown   bool
+	mode    string
+}
+
+func (c fileChanges) needed() bool {
+	return c.copy || c.chmod || c.chown
+}
 
-	_, err = io.Copy(sess.Stdin(), src)
+// Run only uploads the file if the destination is missing or its contents
+// differ and only sets the mode, owner and group if they differ
+func (a *FileAction) Run(ctx context.Context, conn transport.Connection, conf config.Config, _ *vars.Scope) (Result, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(conf.PlaybookFolder, a.Src))
 	if err != nil {
-		return fmt.Errorf("failed to write remote file contents: %s", err)
+		return Result{}, fmt.Errorf("failed to open source file: %s", err)
 	}
 
-	_, err = fmt.Fprint(sess.Stdin(), "\x00")
+	return a.apply(ctx, conn, conf, contents, false)
+}
+
+// Check compares the checksum, mode, owner and group of the destination
+// with the requested ones
+func (a *FileAction) Check(ctx context.Context, conn transport.Connection, conf config.Config, _ *vars.Scope) (Result, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(conf.PlaybookFolder, a.Src))
 	if err != nil {
-		return fmt.Errorf("failed to close remote file: %s", err)
+		return Result{}, fmt.Errorf("failed to open source file: %s", err)
 	}
 
-	return nil
+	return a.apply(ctx, conn, conf, contents, true)
 }
 
-func (a *FileAction) Run(ctx context.Context, conn transport.Connection, conf config.Config) error {
-	err := conn.Exec(ctx, false, func(sess *transport.Session) (error, *errgroup.Group) {
-		f, err := os.Open(filepath.Join(conf.PlaybookFolder, a.Src))
-		if err != nil {
-			return fmt.Errorf("failed to open source file: %s", err), nil
-		}
-		stat, err := f.Stat()
-		if err != nil {
-			return fmt.Errorf("failed to get source file info: %s", err), nil
-		}
+// apply writes contents to Dest and sets the requested owner, group and
+// mode. The steps which wouldn't change anything are skipped and, if dryRun
+// is set, all of them are. In diff mode, the changes to the contents of
+// Dest are printed first.
+func (a *FileAction) apply(ctx context.Context, conn transport.Connection, conf config.Config, contents []byte, dryRun bool) (Result, error) {
+	changes, err := a.changes(ctx, conn, checksum(contents))
+	if err != nil {
+		return Result{}, err
+	}
 
-		// Start scp receiver on the remote host
-		err = sess.Start("scp -qt " + filepath.Dir(a.Dest))
+	if conf.Diff && changes.copy {
+		diff, err := a.diff(ctx, conn, changes.current, contents)
 		if err != nil {
-			return fmt.Errorf("failed to start scp receiver: %s", err), nil
+			return Result{}, err
 		}
+		printDiff(fmt.Sprintf("Changes to %q on %q:\n%s", a.Dest, conn.GetAddress(), diff))
+	}
+
+	if !changes.needed() || dryRun {
+		return resultFor(changes.needed()), nil
+	}
 
-		mode := a.Mode
-		if mode == "" {
-			mode = "0644"
+	if changes.copy {
+		err = a.copy(ctx, conn, bytes.NewReader(contents), int64(len(contents)), changes.mode)
+		if err != nil {
+			return Result{}, err
 		}
+	}
 
-		var g errgroup.Group
-		g.Go(func() error {
-			return copyFile(
-				sess,
-				f,
-				stat.Size(),
-				a.Dest,
-				mode,
-			)
+	if changes.chmod {
+		_, err = conn.Exec(ctx, true, func(sess *transport.Session) (error, *errgroup.Group) {
+			return sess.Start(fmt.Sprintf("chmod %s %s", changes.mode, a.Dest)), nil
 		})
-		return nil, &g
-	})
-	if err != nil {
-		return fmt.Errorf("failed to copy file %q: %s", a.Src, err)
+		if err != nil {
+			return Result{}, fmt.Errorf("failed to set the file mode on %q to %s: %s", a.Dest, changes.mode, err)
+		}
 	}
 
-	if a.Owner != "" && a.Group != "" {
-		err = conn.Exec(ctx, true, func(sess *transport.Session) (error, *errgroup.Group) {
+	if changes.chown {
+		_, err = conn.Exec(ctx, true, func(sess *transport.Session) (error, *errgroup.Group) {
 			return sess.Start(
 				fmt.Sprintf("chown %s:%s %s", a.Owner, a.Group, a.Dest),
 			), nil
 		})
 		if err != nil {
-			return fmt.Errorf(
+			return Result{}, fmt.Errorf(
 				"failed to set the file owner on %q to %s:%s: %s",
 				a.Dest, a.Owner, a.Group, err,
 			)
 		}
 	}
 
+	return resultFor(true), nil
+}
+
+// changes compares the destination with the requested contents, which have
+// the given sha256 checksum, mode, owner and group
+func (a *FileAction) changes(ctx context.Context, conn transport.Connection, checksum string) (fileChanges, error) {
+	mode := a.Mode
+	if mode == "" {
+		mode = "0644"
+	}
+
+	current, err := a.remoteFile(ctx, conn)
+	if err != nil {
+		return fileChanges{}, err
+	}
+
+	changes := fileChanges{
+		current: current,
+		copy:    !current.exists || current.checksum != checksum,
+		chmod:   current.exists && !sameMode(current.mode, mode),
+		mode:    mode,
+	}
+	changes.chown = a.Owner != "" && a.Group != "" &&
+		(changes.copy || current.owner != a.Owner || current.group != a.Group)
+
+	return changes, nil
+}
+
+// diff returns the unified diff between the current contents of Dest and
+// contents, unless either of them is too large or binary
+func (a *FileAction) diff(ctx context.Context, conn transport.Connection, current remoteFile, contents []byte) (string, error) {
+	if current.size > maxDiffSize || len(contents) > maxDiffSize {
+		return fmt.Sprintf("Skipped diff of files larger than %d bytes\n", maxDiffSize), nil
+	}
+
+	oldName := "/dev/null"
+	var old []byte
+	if current.exists {
+		oldName = a.Dest
+		// Encode the contents, so they are not altered by the pseudo terminal
+		res, err := conn.Exec(ctx, true, func(sess *transport.Session) (error, *errgroup.Group) {
+			return sess.Start(fmt.Sprintf("base64 %s", a.Dest)), nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to read the contents of %q: %s", a.Dest, err)
+		}
+
+		old, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(res.Stdout), ""))
+		if err != nil {
+			return "", fmt.Errorf("failed to decode the contents of %q: %s", a.Dest, err)
+		}
+	}
+
+	if isBinary(old) || isBinary(contents) {
+		return fmt.Sprintf("Binary files %s and %s differ\n", oldName, a.Dest), nil
+	}
+
+	return unifiedDiff(oldName, a.Dest, old, contents), nil
+}
+
+// copy writes the contents of src to Dest with the given mode
+func (a *FileAction) copy(ctx context.Context, conn transport.Connection, src io.Reader, size int64, mode string) (err error) {
+	if !a.GetBecome().Enabled() {
+		err = conn.CopyFile(ctx, src, size, a.Dest, mode)
+		if err != nil {
+			return fmt.Errorf("failed to copy file %q: %s", a.Src, err)
+		}
+
+		return nil
+	}
+
+	// With become, the file is uploaded by the user who logged in to a
+	// shared temporary folder and then the target user copies it in place
+	loginConn := transport.WithoutBecome(conn)
+	dir, err := tempDir(ctx, loginConn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, rmErr := loginConn.Exec(ctx, true, func(sess *transport.Session) (error, *errgroup.Group) {
+			return sess.Start(fmt.Sprintf("rm -rf %s", dir)), nil
+		})
+		if rmErr != nil && err == nil {
+			err = fmt.Errorf("failed to remove temporary folder %q: %s", dir, rmErr)
+		}
+	}()
+
+	name, err := tempFileName(a.Dest)
+	if err != nil {
+		return err
+	}
+	tmp := path.Join(dir, name)
+
+	// The folder can't be listed by others, so the random file name keeps
+	// the contents private until they are copied
+	err = loginConn.CopyFile(ctx, src, size, tmp, "0644")
+	if err != nil {
+		return fmt.Errorf("failed to copy file %q: %s", a.Src, err)
+	}
+
+	_, err = conn.Exec(ctx, true, func(sess *transport.Session) (error, *errgroup.Group) {
+		return sess.Start(fmt.Sprintf(
+			`cp %[1]s %[2]s && chown "$(id -un):$(id -gn)" %[2]s && chmod %[3]s %[2]s`,
+			tmp, a.Dest, mode,
+		)), nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy file in place at %q: %s", a.Dest, err)
+	}
+
 	return nil
 }
+
+// tempDir creates a temporary folder which can be traversed, but not listed,
+// by other users
+func tempDir(ctx context.Context, conn transport.Connection) (string, error) {
+	res, err := conn.Exec(ctx, true, func(sess *transport.Session) (error, *errgroup.Group) {
+		return sess.Start(`dir=$(mktemp -d "${TMPDIR:-/tmp}/.wormhole-XXXXXXXX") && chmod 0711 "$dir" && echo "$dir"`), nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary folder: %s", err)
+	}
+
+	dir := strings.TrimSpace(res.Stdout)
+	if dir == "" {
+		return "", errors.New("failed to create temporary folder: mktemp printed nothing")
+	}
+
+	return dir, nil
+}
+
+// remoteFile returns the owner, group, mode, size and sha256 checksum of
+// Dest, if it's a regular file
+func (a *FileAction) remoteFile(ctx context.Context, conn transport.Connection) (remoteFile, error) {
+	res, err := conn.Exec(ctx, true, func(sess *transport.Session) (error, *errgroup.Group) {
+		return sess.Start(remoteFileCommand(a.Dest)), nil
+	})
+	if err != nil {
+		return remoteFile{}, fmt.Errorf("failed to get the state of file %q: %s", a.Dest, err)
+	}
+
+	// The output contains the owner, group, mode and size, then the
+	// checksum and the path
+	fields := strings.Fields(res.Stdout)
+	if len(fields) < 5 {
+		return remoteFile{}, nil
+	}
+
+	size, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return remoteFile{}, fmt.Errorf("failed to parse the size of file %q: %s", a.Dest, err)
+	}
+
+	return remoteFile{
+		exists:   true,
+		owner:    fields[0],
+		group:    fields[1],
+		mode:     fields[2],
+		size:     size,
+		checksum: fields[4],
+	}, nil
+}
+
+// remoteFileCommand prints the owner, group, mode, size and sha256 checksum
+// of dest, if it's a regular file
+func remoteFileCommand(dest string) string {
+	return fmt.Sprintf("if [ -f %[1]s ]; then stat -c '%%U %%G %%a %%s' %[1]s && sha256sum %[1]s; fi", dest)
+}
+
+// checksum returns the hex encoded sha256 checksum of data
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sameMode compares two octal file modes, which may have leading zeros
+func sameMode(a, b string) bool {
+	modeA, errA := strconv.ParseUint(a, 8, 32)
+	modeB, errB := strconv.ParseUint(b, 8, 32)
+
+	return errA == nil && errB == nil && modeA == modeB
+}
+
+// tempFileName returns a random file name for staging dest
+func tempFileName(dest string) (string, error) {
+	suffix := make([]byte, 8)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate temporary file name: %s", err)
+	}
+
+	return fmt.Sprintf(".wormhole-%s-%s", hex.EncodeToString(suffix), path.Base(dest)), nil
+}
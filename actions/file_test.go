@@ -0,0 +1,237 @@
+package actions
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mihaitodor/wormhole/config"
+	"github.com/mihaitodor/wormhole/transport"
+	"github.com/mihaitodor/wormhole/transport/sshtest"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// newTestConnection connects to a sshtest server
+func newTestConnection(c C) (*sshtest.Server, transport.Connection) {
+	server, err := sshtest.NewServer("frodo", "mellon")
+	c.So(err, ShouldBeNil)
+
+	conn, err := transport.NewConnection(server.Inventory(), config.Config{
+		ConnectTimeout:  500 * time.Millisecond,
+		HostKeyChecking: config.HostKeyCheckingOff,
+	})
+	c.So(err, ShouldBeNil)
+
+	return server, conn
+}
+
+func Test_FileAction(t *testing.T) {
+	Convey("FileAction.Run()", t, func(c C) {
+		server, conn := newTestConnection(c)
+		Reset(func() {
+			So(conn.Close(), ShouldBeNil)
+			So(server.Close(), ShouldBeNil)
+		})
+
+		So(os.Mkdir(filepath.Join(server.Root, "shire"), 0755), ShouldBeNil)
+		dest := filepath.Join(server.Root, "shire", "ring.txt")
+		conf := config.Config{PlaybookFolder: "fixtures"}
+
+		expected, err := ioutil.ReadFile(filepath.Join("fixtures", "ring.txt"))
+		So(err, ShouldBeNil)
+
+		Convey("should copy the file with the default mode", func() {
+			action := FileAction{Src: "ring.txt", Dest: "shire/ring.txt"}
+			result, err := action.Run(context.Background(), conn, conf, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusChanged)
+			So(server.Commands(), ShouldResemble, []string{
+				remoteFileCommand("shire/ring.txt"),
+				"scp -qt shire",
+			})
+
+			contents, err := ioutil.ReadFile(dest)
+			So(err, ShouldBeNil)
+			So(contents, ShouldResemble, expected)
+
+			stat, err := os.Stat(dest)
+			So(err, ShouldBeNil)
+			So(stat.Mode().Perm(), ShouldEqual, os.FileMode(0644))
+		})
+
+		Convey("should set the mode, owner and group", func() {
+			u, err := user.Current()
+			So(err, ShouldBeNil)
+			g, err := user.LookupGroupId(u.Gid)
+			So(err, ShouldBeNil)
+
+			action := FileAction{
+				Src:   "ring.txt",
+				Dest:  "shire/ring.txt",
+				Owner: u.Username,
+				Group: g.Name,
+				Mode:  "0600",
+			}
+			result, err := action.Run(context.Background(), conn, conf, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusChanged)
+			So(server.Commands(), ShouldResemble, []string{
+				remoteFileCommand("shire/ring.txt"),
+				"scp -qt shire",
+				"chown " + u.Username + ":" + g.Name + " shire/ring.txt",
+			})
+
+			stat, err := os.Stat(dest)
+			So(err, ShouldBeNil)
+			So(stat.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+		})
+
+		Convey("should copy the file in place as the become user", func() {
+			server.BecomePassword = "friend"
+			inv := server.Inventory()
+			inv.BecomePassword = "friend"
+			conn, err := transport.NewConnection(inv, config.Config{
+				ConnectTimeout:  500 * time.Millisecond,
+				HostKeyChecking: config.HostKeyCheckingOff,
+			})
+			So(err, ShouldBeNil)
+			Reset(func() { So(conn.Close(), ShouldBeNil) })
+
+			u, err := user.Current()
+			So(err, ShouldBeNil)
+
+			yes := true
+			action := FileAction{Src: "ring.txt", Dest: "shire/ring.txt", Mode: "0600"}
+			action.InheritBecome(BecomeSettings{Become: &yes, BecomeUser: u.Username})
+			_, err = action.Run(context.Background(), transport.WithBecome(conn, "", u.Username), conf, nil)
+			So(err, ShouldBeNil)
+
+			// Only the checksum and the final copy run as the become user
+			tmpDir := filepath.Join(server.Root, "tmp", ".wormhole-")
+			commands := server.Commands()
+			So(commands, ShouldHaveLength, 5)
+			So(commands[0], ShouldStartWith, "sudo -S -p ")
+			So(commands[0], ShouldContainSubstring, "sha256sum shire/ring.txt")
+			So(commands[1], ShouldStartWith, "dir=$(mktemp -d ")
+			So(commands[2], ShouldStartWith, "scp -qt "+tmpDir)
+			So(commands[3], ShouldStartWith, "sudo -S -p ")
+			So(commands[3], ShouldContainSubstring, "cp "+tmpDir)
+			So(commands[4], ShouldStartWith, "rm -rf "+tmpDir)
+
+			contents, err := ioutil.ReadFile(dest)
+			So(err, ShouldBeNil)
+			So(contents, ShouldResemble, expected)
+
+			stat, err := os.Stat(dest)
+			So(err, ShouldBeNil)
+			So(stat.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+
+			// The temporary folder is gone
+			leftovers, err := filepath.Glob(filepath.Join(server.Root, "tmp", "*"))
+			So(err, ShouldBeNil)
+			So(leftovers, ShouldBeEmpty)
+		})
+
+		Convey("should not change files which are up to date", func() {
+			So(ioutil.WriteFile(dest, expected, 0644), ShouldBeNil)
+
+			action := FileAction{Src: "ring.txt", Dest: "shire/ring.txt"}
+			result, err := action.Run(context.Background(), conn, conf, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusOK)
+			So(server.Commands(), ShouldResemble, []string{remoteFileCommand("shire/ring.txt")})
+		})
+
+		Convey("should only set the mode when the contents are up to date", func() {
+			So(ioutil.WriteFile(dest, expected, 0644), ShouldBeNil)
+
+			action := FileAction{Src: "ring.txt", Dest: "shire/ring.txt", Mode: "0600"}
+			result, err := action.Run(context.Background(), conn, conf, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusChanged)
+			So(server.Commands(), ShouldResemble, []string{
+				remoteFileCommand("shire/ring.txt"),
+				"chmod 0600 shire/ring.txt",
+			})
+
+			stat, err := os.Stat(dest)
+			So(err, ShouldBeNil)
+			So(stat.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+		})
+
+		Convey("should replace files with different contents", func() {
+			So(ioutil.WriteFile(dest, []byte("brass"), 0644), ShouldBeNil)
+
+			action := FileAction{Src: "ring.txt", Dest: "shire/ring.txt"}
+			result, err := action.Run(context.Background(), conn, conf, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusChanged)
+
+			contents, err := ioutil.ReadFile(dest)
+			So(err, ShouldBeNil)
+			So(contents, ShouldResemble, expected)
+		})
+
+		Convey("should only report changes in check mode", func() {
+			action := FileAction{Src: "ring.txt", Dest: "shire/ring.txt"}
+			result, err := action.Check(context.Background(), conn, conf, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusChanged)
+			So(server.Commands(), ShouldResemble, []string{remoteFileCommand("shire/ring.txt")})
+
+			_, err = os.Stat(dest)
+			So(os.IsNotExist(err), ShouldBeTrue)
+
+			So(ioutil.WriteFile(dest, expected, 0644), ShouldBeNil)
+			result, err = action.Check(context.Background(), conn, conf, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusOK)
+		})
+
+		Convey("should print the changes to the contents in diff mode", func() {
+			var output bytes.Buffer
+			diffOutput = &output
+			Reset(func() { diffOutput = os.Stdout })
+			So(ioutil.WriteFile(dest, []byte("brass\n"), 0644), ShouldBeNil)
+
+			conf.Diff = true
+			action := FileAction{Src: "ring.txt", Dest: "shire/ring.txt"}
+			result, err := action.Check(context.Background(), conn, conf, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusChanged)
+			So(output.String(), ShouldStartWith, "Changes to \"shire/ring.txt\" on \""+conn.GetAddress()+"\":\n")
+			So(output.String(), ShouldContainSubstring, "--- shire/ring.txt\n+++ shire/ring.txt\n")
+			So(output.String(), ShouldContainSubstring, "\n-brass\n")
+			So(output.String(), ShouldContainSubstring, "\n+"+strings.SplitAfter(string(expected), "\n")[0])
+
+			Convey("but skip binary files", func() {
+				output.Reset()
+				So(ioutil.WriteFile(dest, []byte("brass\x00"), 0644), ShouldBeNil)
+
+				_, err := action.Check(context.Background(), conn, conf, nil)
+				So(err, ShouldBeNil)
+				So(output.String(), ShouldEndWith, "Binary files shire/ring.txt and shire/ring.txt differ\n")
+			})
+		})
+
+		Convey("should fail when the source file is missing", func() {
+			action := FileAction{Src: "one.txt", Dest: "shire/one.txt"}
+			_, err := action.Run(context.Background(), conn, conf, nil)
+			So(err.Error(), ShouldContainSubstring, "failed to open source file")
+			So(server.Commands(), ShouldBeEmpty)
+		})
+
+		Convey("should fail when the destination folder is missing", func() {
+			action := FileAction{Src: "ring.txt", Dest: "mordor/ring.txt"}
+			_, err := action.Run(context.Background(), conn, conf, nil)
+			So(err.Error(), ShouldContainSubstring, "failed to copy file \"ring.txt\"")
+			So(err.Error(), ShouldContainSubstring, "No such file or directory")
+		})
+	})
+}
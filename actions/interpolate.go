@@ -0,0 +1,115 @@
+package actions
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/mihaitodor/wormhole/vars"
+)
+
+// placeholder matches the variable references in action fields, such as
+// `{{ app_name }}`
+var placeholder = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// Interpolate returns a copy of the action where every `{{ name }}` in its
+// string fields has been replaced with the value of the variable from scope.
+// Other braces, such as the Go templates of `docker ps --format '{{.Names}}'`,
+// are left as they are. The original action is left untouched, since it is
+// shared between hosts.
+func Interpolate(a Action, scope *vars.Scope) (Action, error) {
+	orig := reflect.ValueOf(a)
+	if orig.Kind() != reflect.Ptr || orig.Elem().Kind() != reflect.Struct {
+		return a, nil
+	}
+
+	interpolated := reflect.New(orig.Elem().Type())
+	interpolated.Elem().Set(orig.Elem())
+
+	err := interpolateStruct(interpolated.Elem(), scope)
+	if err != nil {
+		return nil, err
+	}
+
+	return interpolated.Interface().(Action), nil
+}
+
+func interpolateStruct(v reflect.Value, scope *vars.Scope) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if !field.CanSet() {
+			continue
+		}
+
+		name := fieldName(v.Type().Field(i))
+
+		switch field.Kind() {
+		case reflect.Struct:
+			err := interpolateStruct(field, scope)
+			if err != nil {
+				return err
+			}
+		case reflect.String:
+			value, err := interpolateString(name, field.String(), scope)
+			if err != nil {
+				return err
+			}
+			field.SetString(value)
+		case reflect.Slice:
+			if field.Type().Elem().Kind() != reflect.String {
+				continue
+			}
+
+			// Copy the slice so the original action doesn't change
+			items := reflect.MakeSlice(field.Type(), field.Len(), field.Len())
+			for j := 0; j < field.Len(); j++ {
+				value, err := interpolateString(name, field.Index(j).String(), scope)
+				if err != nil {
+					return err
+				}
+				items.Index(j).SetString(value)
+			}
+			if !field.IsNil() {
+				field.Set(items)
+			}
+		}
+	}
+
+	return nil
+}
+
+func interpolateString(name, value string, scope *vars.Scope) (string, error) {
+	var err error
+	interpolated := placeholder.ReplaceAllStringFunc(value, func(match string) string {
+		key := placeholder.FindStringSubmatch(match)[1]
+
+		var v interface{}
+		var ok bool
+		if scope != nil {
+			v, ok = scope.Vars[key]
+		}
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("failed to interpolate %q: undefined variable %q", name, key)
+			}
+			return match
+		}
+
+		return fmt.Sprint(v)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return interpolated, nil
+}
+
+// fieldName returns the name of the field as it appears in the playbook
+func fieldName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("mapstructure"), ",")[0]
+	if name == "" {
+		return strings.ToLower(f.Name)
+	}
+	return name
+}
@@ -0,0 +1,67 @@
+package actions
+
+import (
+	"testing"
+
+	"github.com/mihaitodor/wormhole/vars"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Interpolate(t *testing.T) {
+	Convey("Interpolate()", t, func() {
+		scope := vars.NewScope(vars.Vars{"realm": "gondor", "user": "isildur"}, nil)
+
+		Convey("should render string fields and leave the original action untouched", func() {
+			action, err := UnmarshalAction("template", map[string]interface{}{
+				"src":         "{{ realm }}.conf.tmpl",
+				"dest":        "/etc/{{realm}}/{{ user }}.conf",
+				"mode":        "0644",
+				"become":      true,
+				"become_user": "{{ user }}",
+			})
+			So(err, ShouldBeNil)
+
+			interpolated, err := Interpolate(action, scope)
+			So(err, ShouldBeNil)
+
+			a := interpolated.(*TemplateAction)
+			So(a.Src, ShouldEqual, "gondor.conf.tmpl")
+			So(a.Dest, ShouldEqual, "/etc/gondor/isildur.conf")
+			So(a.Mode, ShouldEqual, "0644")
+			So(a.GetBecome().BecomeUser, ShouldEqual, "isildur")
+			So(a.GetType(), ShouldEqual, "template")
+			So(action.(*TemplateAction).Dest, ShouldEqual, "/etc/{{realm}}/{{ user }}.conf")
+		})
+
+		Convey("should render string lists into a copy", func() {
+			action, err := UnmarshalAction("apt", map[string]interface{}{
+				"state": "install",
+				"pkg":   []interface{}{"{{ realm }}-beacons", "palantir"},
+			})
+			So(err, ShouldBeNil)
+
+			interpolated, err := Interpolate(action, scope)
+			So(err, ShouldBeNil)
+			So(interpolated.(*AptAction).Pkg, ShouldResemble, []string{"gondor-beacons", "palantir"})
+			So(action.(*AptAction).Pkg, ShouldResemble, []string{"{{ realm }}-beacons", "palantir"})
+		})
+
+		Convey("should leave other braces untouched", func() {
+			action, err := UnmarshalAction("shell", "docker ps --format '{{.Names}} {{ json .Ports }}' > {{ realm }}.txt")
+			So(err, ShouldBeNil)
+
+			interpolated, err := Interpolate(action, scope)
+			So(err, ShouldBeNil)
+			So(interpolated.(*ShellAction).Command, ShouldEqual, "docker ps --format '{{.Names}} {{ json .Ports }}' > gondor.txt")
+		})
+
+		Convey("should fail for undefined variables", func() {
+			action, err := UnmarshalAction("shell", "echo {{ steward }}")
+			So(err, ShouldBeNil)
+
+			_, err = Interpolate(action, scope)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, `failed to interpolate "command": undefined variable "steward"`)
+		})
+	})
+}
@@ -0,0 +1,27 @@
+package actions
+
+// Status is the outcome of an action which ran successfully
+type Status string
+
+const (
+	// StatusOK means that the host was already in the requested state
+	StatusOK Status = "ok"
+	// StatusChanged means that the action changed the host
+	StatusChanged Status = "changed"
+	// StatusSkipped means that the action didn't run
+	StatusSkipped Status = "skipped"
+)
+
+// Result is returned by actions which ran successfully
+type Result struct {
+	Status Status
+}
+
+// resultFor returns StatusChanged if changed is true and StatusOK otherwise
+func resultFor(changed bool) Result {
+	if changed {
+		return Result{Status: StatusChanged}
+	}
+
+	return Result{Status: StatusOK}
+}
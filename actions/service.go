@@ -6,17 +6,61 @@ import (
 
 	"github.com/mihaitodor/wormhole/config"
 	"github.com/mihaitodor/wormhole/transport"
+	"github.com/mihaitodor/wormhole/vars"
 	"golang.org/x/sync/errgroup"
 )
 
 type ServiceAction struct {
-	ActionBase
-	Name  string `mapstructure:"name"`
-	State string `mapstructure:"state"`
+	ActionBase `mapstructure:",squash"`
+	Name       string `mapstructure:"name"`
+	State      string `mapstructure:"state"`
 }
 
-func (a *ServiceAction) Run(ctx context.Context, conn transport.Connection, _ config.Config) error {
-	return conn.Exec(ctx, true, func(sess *transport.Session) (error, *errgroup.Group) {
+// Run only starts or stops the service if it's not running or stopped
+// already. Other states, such as restart, always change the host.
+func (a *ServiceAction) Run(ctx context.Context, conn transport.Connection, conf config.Config, scope *vars.Scope) (Result, error) {
+	result, err := a.Check(ctx, conn, conf, scope)
+	if err != nil || result.Status == StatusOK {
+		return result, err
+	}
+
+	_, err = conn.Exec(ctx, true, func(sess *transport.Session) (error, *errgroup.Group) {
 		return sess.Start(fmt.Sprintf("service %s %s", a.Name, a.State)), nil
 	})
+	if err != nil {
+		return Result{}, err
+	}
+
+	return resultFor(true), nil
+}
+
+// Check queries the status of the service for the start and stop states.
+// Other states are always reported as changes.
+func (a *ServiceAction) Check(ctx context.Context, conn transport.Connection, _ config.Config, _ *vars.Scope) (Result, error) {
+	if a.State != "start" && a.State != "stop" {
+		return resultFor(true), nil
+	}
+
+	running, err := a.isRunning(ctx, conn)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return resultFor(running != (a.State == "start")), nil
+}
+
+// isRunning checks the status of the service, which exits with a non-zero
+// status if the service is not running
+func (a *ServiceAction) isRunning(ctx context.Context, conn transport.Connection) (bool, error) {
+	_, err := conn.Exec(ctx, true, func(sess *transport.Session) (error, *errgroup.Group) {
+		return sess.Start(fmt.Sprintf("service %s status", a.Name)), nil
+	})
+	if _, ok := err.(*transport.ExitError); ok {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get the status of service %q: %s", a.Name, err)
+	}
+
+	return true, nil
 }
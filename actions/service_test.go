@@ -0,0 +1,136 @@
+package actions
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mihaitodor/wormhole/config"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeService tracks the running services via <name>.running files and
+// fails to start the balrog service
+const fakeService = `# service <name> <command>
+case "$2" in
+status) [ -f "$1.running" ] ;;
+start|restart)
+	if [ "$1" = balrog ]; then
+		echo "Job for balrog.service failed" >&2
+		exit 1
+	fi
+	touch "$1.running"
+	;;
+stop) rm -f "$1.running" ;;
+*) echo "Usage: service <name> {start|stop|restart|status}" >&2; exit 1 ;;
+esac
+`
+
+func Test_ServiceAction(t *testing.T) {
+	Convey("ServiceAction.Run()", t, func(c C) {
+		server, conn := newTestConnection(c)
+		Reset(func() {
+			So(conn.Close(), ShouldBeNil)
+			So(server.Close(), ShouldBeNil)
+		})
+
+		So(server.AddCommand("service", fakeService), ShouldBeNil)
+		running := filepath.Join(server.Root, "nginx.running")
+
+		Convey("should start the service when it's stopped", func() {
+			action := ServiceAction{Name: "nginx", State: "start"}
+			result, err := action.Run(context.Background(), conn, config.Config{}, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusChanged)
+			So(server.Commands(), ShouldResemble, []string{"service nginx status", "service nginx start"})
+			_, err = os.Stat(running)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("should not start the service when it's running", func() {
+			So(ioutil.WriteFile(running, nil, 0644), ShouldBeNil)
+
+			action := ServiceAction{Name: "nginx", State: "start"}
+			result, err := action.Run(context.Background(), conn, config.Config{}, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusOK)
+			So(server.Commands(), ShouldResemble, []string{"service nginx status"})
+		})
+
+		Convey("should stop the service when it's running", func() {
+			So(ioutil.WriteFile(running, nil, 0644), ShouldBeNil)
+
+			action := ServiceAction{Name: "nginx", State: "stop"}
+			result, err := action.Run(context.Background(), conn, config.Config{}, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusChanged)
+			_, err = os.Stat(running)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("should not stop the service when it's stopped", func() {
+			action := ServiceAction{Name: "nginx", State: "stop"}
+			result, err := action.Run(context.Background(), conn, config.Config{}, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusOK)
+			So(server.Commands(), ShouldResemble, []string{"service nginx status"})
+		})
+
+		Convey("should always restart the service", func() {
+			So(ioutil.WriteFile(running, nil, 0644), ShouldBeNil)
+
+			action := ServiceAction{Name: "nginx", State: "restart"}
+			result, err := action.Run(context.Background(), conn, config.Config{}, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusChanged)
+			So(server.Commands(), ShouldResemble, []string{"service nginx restart"})
+		})
+
+		Convey("should return an error when the service fails to start", func() {
+			action := ServiceAction{Name: "balrog", State: "start"}
+			_, err := action.Run(context.Background(), conn, config.Config{}, nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "command exited with status 1\nJob for balrog.service failed")
+		})
+	})
+
+	Convey("ServiceAction.Check()", t, func(c C) {
+		server, conn := newTestConnection(c)
+		Reset(func() {
+			So(conn.Close(), ShouldBeNil)
+			So(server.Close(), ShouldBeNil)
+		})
+
+		So(server.AddCommand("service", fakeService), ShouldBeNil)
+		running := filepath.Join(server.Root, "nginx.running")
+
+		Convey("should report starting a stopped service as a change", func() {
+			action := ServiceAction{Name: "nginx", State: "start"}
+			result, err := action.Check(context.Background(), conn, config.Config{}, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusChanged)
+			So(server.Commands(), ShouldResemble, []string{"service nginx status"})
+			_, err = os.Stat(running)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("should report ok when the service is in the requested state", func() {
+			So(ioutil.WriteFile(running, nil, 0644), ShouldBeNil)
+
+			action := ServiceAction{Name: "nginx", State: "start"}
+			result, err := action.Check(context.Background(), conn, config.Config{}, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusOK)
+		})
+
+		Convey("should report restarts as changes without running anything", func() {
+			action := ServiceAction{Name: "nginx", State: "restart"}
+			result, err := action.Check(context.Background(), conn, config.Config{}, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusChanged)
+			So(server.Commands(), ShouldBeEmpty)
+		})
+	})
+}
@@ -5,18 +5,46 @@ import (
 
 	"github.com/mihaitodor/wormhole/config"
 	"github.com/mihaitodor/wormhole/transport"
+	"github.com/mihaitodor/wormhole/vars"
 	"golang.org/x/sync/errgroup"
 )
 
 type ShellAction struct {
-	ActionBase
-	// Use the generic tag "data" because this action is represented
-	// as `key: string_value` in the playbook YAML
-	Command string `mapstructure:"data"`
+	ActionBase `mapstructure:",squash"`
+	// Command can also be given as `shell: string_value` in the playbook YAML
+	Command string `mapstructure:"command"`
+	// Safe marks commands which don't change anything, so they also run in
+	// check mode
+	Safe bool `mapstructure:"safe"`
 }
 
-func (a *ShellAction) Run(ctx context.Context, conn transport.Connection, _ config.Config) error {
-	return conn.Exec(ctx, true, func(sess *transport.Session) (error, *errgroup.Group) {
+func (a *ShellAction) shorthandField() string {
+	return "command"
+}
+
+// Run runs the command, which is always considered to change the host
+func (a *ShellAction) Run(ctx context.Context, conn transport.Connection, _ config.Config, _ *vars.Scope) (Result, error) {
+	_, err := conn.Exec(ctx, true, func(sess *transport.Session) (error, *errgroup.Group) {
 		return sess.Start(a.Command), nil
 	})
+	if err != nil {
+		return Result{}, err
+	}
+
+	return resultFor(true), nil
+}
+
+// Check only runs the command if it's marked as safe. Safe commands don't
+// change anything, so they are reported as ok.
+func (a *ShellAction) Check(ctx context.Context, conn transport.Connection, conf config.Config, scope *vars.Scope) (Result, error) {
+	if !a.Safe {
+		return Result{Status: StatusSkipped}, nil
+	}
+
+	_, err := a.Run(ctx, conn, conf, scope)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return resultFor(false), nil
 }
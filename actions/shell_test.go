@@ -0,0 +1,71 @@
+package actions
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mihaitodor/wormhole/config"
+	"github.com/mihaitodor/wormhole/transport"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ShellAction(t *testing.T) {
+	Convey("ShellAction.Run()", t, func(c C) {
+		server, conn := newTestConnection(c)
+		Reset(func() {
+			So(conn.Close(), ShouldBeNil)
+			So(server.Close(), ShouldBeNil)
+		})
+
+		Convey("should run the command on the server", func() {
+			action := ShellAction{Command: "echo precious > ring.txt"}
+			result, err := action.Run(context.Background(), conn, config.Config{}, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusChanged)
+			So(server.Commands(), ShouldResemble, []string{"echo precious > ring.txt"})
+
+			contents, err := ioutil.ReadFile(filepath.Join(server.Root, "ring.txt"))
+			So(err, ShouldBeNil)
+			So(string(contents), ShouldEqual, "precious\n")
+		})
+
+		Convey("should only run safe commands in check mode", func() {
+			action := ShellAction{Command: "echo precious > ring.txt"}
+			result, err := action.Check(context.Background(), conn, config.Config{}, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusSkipped)
+			So(server.Commands(), ShouldBeEmpty)
+
+			action.Safe = true
+			result, err = action.Check(context.Background(), conn, config.Config{}, nil)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusOK)
+			So(server.Commands(), ShouldResemble, []string{"echo precious > ring.txt"})
+
+			action = ShellAction{Command: "exit 1", Safe: true}
+			_, err = action.Check(context.Background(), conn, config.Config{}, nil)
+			So(err, ShouldHaveSameTypeAs, &transport.ExitError{})
+		})
+
+		Convey("should return the command output on failure", func() {
+			action := ShellAction{Command: "echo 'you shall not pass'; exit 1"}
+			_, err := action.Run(context.Background(), conn, config.Config{}, nil)
+			So(err, ShouldHaveSameTypeAs, &transport.ExitError{})
+			So(err.Error(), ShouldEqual, "command exited with status 1\nyou shall not pass")
+		})
+
+		Convey("should interrupt the command when cancelled", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			action := ShellAction{Command: "sleep 10"}
+			_, err := action.Run(ctx, conn, config.Config{}, nil)
+			So(err == context.DeadlineExceeded, ShouldBeTrue)
+			So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+		})
+	})
+}
@@ -0,0 +1,169 @@
+package actions
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/mihaitodor/wormhole/config"
+	"github.com/mihaitodor/wormhole/transport"
+	"github.com/mihaitodor/wormhole/vars"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// TemplateAction renders a local Go template and uploads the result with the
+// same semantics as FileAction
+type TemplateAction struct {
+	FileAction `mapstructure:",squash"`
+}
+
+func (a *TemplateAction) Run(ctx context.Context, conn transport.Connection, conf config.Config, scope *vars.Scope) (Result, error) {
+	rendered, err := a.render(ctx, conf, scope)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return a.apply(ctx, conn, conf, rendered, false)
+}
+
+// Check renders the template and compares the result with the destination
+func (a *TemplateAction) Check(ctx context.Context, conn transport.Connection, conf config.Config, scope *vars.Scope) (Result, error) {
+	rendered, err := a.render(ctx, conf, scope)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return a.apply(ctx, conn, conf, rendered, true)
+}
+
+func (a *TemplateAction) render(ctx context.Context, conf config.Config, scope *vars.Scope) ([]byte, error) {
+	text, err := ioutil.ReadFile(filepath.Join(conf.PlaybookFolder, a.Src))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template: %s", err)
+	}
+
+	rendered, err := renderTemplate(ctx, a.Src, string(text), scope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render template: %s", err)
+	}
+
+	return rendered, nil
+}
+
+// renderTemplate executes the template with the variables from scope as
+// data. Facts are available via the `fact` and `facts` functions.
+func renderTemplate(ctx context.Context, name, text string, scope *vars.Scope) ([]byte, error) {
+	if scope == nil {
+		scope = vars.NewScope(nil, nil)
+	}
+
+	funcs := templateFuncs()
+	funcs["var"] = func(name string) interface{} {
+		return scope.Vars[name]
+	}
+	funcs["facts"] = func() (vars.Vars, error) {
+		return scope.Facts(ctx)
+	}
+	funcs["fact"] = func(name string) (interface{}, error) {
+		facts, err := scope.Facts(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		value, ok := facts[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown fact %q", name)
+		}
+
+		return value, nil
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, templateError(err, name, text)
+	}
+
+	data := map[string]interface{}(scope.Vars)
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return nil, templateError(err, name, text)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// templateError adds the template line which caused the error, if known
+func templateError(err error, name, text string) error {
+	re := regexp.MustCompile(`template: ` + regexp.QuoteMeta(name) + `:(\d+)`)
+	match := re.FindStringSubmatch(err.Error())
+	if match == nil {
+		return err
+	}
+
+	line, _ := strconv.Atoi(match[1])
+	lines := strings.Split(text, "\n")
+	if line < 1 || line > len(lines) {
+		return err
+	}
+
+	return fmt.Errorf("%s\n%4d | %s", err, line, lines[line-1])
+}
+
+// templateFuncs returns the helper functions available to templates. The
+// value being transformed is always the last argument, so they can be used
+// in pipelines, such as `{{ .name | replace "-" "_" | upper }}`.
+func templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"default": func(def, value interface{}) interface{} {
+			if value == nil || value == "" {
+				return def
+			}
+			return value
+		},
+		"upper":     strings.ToUpper,
+		"lower":     strings.ToLower,
+		"title":     strings.Title,
+		"trim":      strings.TrimSpace,
+		"contains":  func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix": func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix": func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"replace":   func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+		"split":     func(sep, s string) []string { return strings.Split(s, sep) },
+		"join": func(sep string, list interface{}) (string, error) {
+			switch l := list.(type) {
+			case []string:
+				return strings.Join(l, sep), nil
+			case []interface{}:
+				items := make([]string, len(l))
+				for i, item := range l {
+					items[i] = fmt.Sprint(item)
+				}
+				return strings.Join(items, sep), nil
+			default:
+				return "", fmt.Errorf("join expects a list, got %T", list)
+			}
+		},
+		"quote": func(value interface{}) string { return strconv.Quote(fmt.Sprint(value)) },
+		"indent": func(n int, s string) string {
+			pad := strings.Repeat(" ", n)
+			return pad + strings.Replace(s, "\n", "\n"+pad, -1)
+		},
+		"toYaml": func(value interface{}) (string, error) {
+			out, err := yaml.Marshal(value)
+			return strings.TrimSuffix(string(out), "\n"), err
+		},
+		"env": os.Getenv,
+	}
+}
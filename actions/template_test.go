@@ -0,0 +1,101 @@
+package actions
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mihaitodor/wormhole/config"
+	"github.com/mihaitodor/wormhole/vars"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_TemplateAction(t *testing.T) {
+	Convey("TemplateAction.Run()", t, func(c C) {
+		server, conn := newTestConnection(c)
+		Reset(func() {
+			So(conn.Close(), ShouldBeNil)
+			So(server.Close(), ShouldBeNil)
+		})
+
+		So(os.Mkdir(filepath.Join(server.Root, "shire"), 0755), ShouldBeNil)
+		conf := config.Config{PlaybookFolder: "fixtures"}
+		scope := vars.NewScope(
+			vars.Vars{"bearer": "frodo baggins", "inscriptions": []interface{}{"one ring", "to rule them all"}},
+			func(ctx context.Context) (vars.Vars, error) {
+				return GatherFacts(ctx, conn)
+			},
+		)
+
+		action, err := UnmarshalAction("template", map[string]interface{}{
+			"src":  "ring.conf.tmpl",
+			"dest": "shire/ring.conf",
+			"mode": "0600",
+		})
+		So(err, ShouldBeNil)
+		So(action, ShouldHaveSameTypeAs, &TemplateAction{})
+
+		Convey("should render the template with variables and facts", func() {
+			result, err := action.Run(context.Background(), conn, conf, scope)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusChanged)
+
+			hostname, err := os.Hostname()
+			So(err, ShouldBeNil)
+
+			dest := filepath.Join(server.Root, "shire", "ring.conf")
+			contents, err := ioutil.ReadFile(dest)
+			So(err, ShouldBeNil)
+			So(string(contents), ShouldEqual, "# Managed by wormhole\n"+
+				"bearer = Frodo Baggins\n"+
+				"host = "+hostname+"\n"+
+				"inscription = \"one ring\"\n"+
+				"inscription = \"to rule them all\"\n"+
+				"port = 8080\n",
+			)
+
+			stat, err := os.Stat(dest)
+			So(err, ShouldBeNil)
+			So(stat.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+		})
+
+		Convey("should only gather facts when needed", func() {
+			scope := vars.NewScope(vars.Vars{"ring": "precious"}, func(context.Context) (vars.Vars, error) {
+				return nil, errors.New("no facts here")
+			})
+
+			action := TemplateAction{FileAction{Src: "missing.tmpl", Dest: "shire/ring.txt"}}
+			result, err := action.Run(context.Background(), conn, conf, scope)
+			So(err, ShouldBeNil)
+			So(result.Status, ShouldEqual, StatusChanged)
+
+			_, err = scope.Facts(context.Background())
+			So(err.Error(), ShouldEqual, "no facts here")
+		})
+
+		Convey("should report the line of parse errors", func() {
+			action := TemplateAction{FileAction{Src: "broken.tmpl", Dest: "shire/ring.txt"}}
+			_, err := action.Run(context.Background(), conn, conf, scope)
+			So(err.Error(), ShouldStartWith, "failed to render template: template: broken.tmpl:2:")
+			So(err.Error(), ShouldEndWith, "\n   2 | second line {{ .ring | }}")
+			So(server.Commands(), ShouldBeEmpty)
+		})
+
+		Convey("should report the line of undefined variables", func() {
+			action := TemplateAction{FileAction{Src: "missing.tmpl", Dest: "shire/ring.txt"}}
+			_, err := action.Run(context.Background(), conn, conf, scope)
+			So(err.Error(), ShouldContainSubstring, "template: missing.tmpl:2:")
+			So(err.Error(), ShouldContainSubstring, "map has no entry for key \"ring\"")
+			So(err.Error(), ShouldEndWith, "\n   2 | two {{ .ring }}")
+		})
+
+		Convey("should fail when the template is missing", func() {
+			action := TemplateAction{FileAction{Src: "nope.tmpl", Dest: "shire/ring.txt"}}
+			_, err := action.Run(context.Background(), conn, conf, scope)
+			So(err.Error(), ShouldContainSubstring, "failed to read template")
+		})
+	})
+}
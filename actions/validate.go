@@ -12,10 +12,11 @@ import (
 
 	"github.com/mihaitodor/wormhole/config"
 	"github.com/mihaitodor/wormhole/transport"
+	"github.com/mihaitodor/wormhole/vars"
 )
 
 type ValidateAction struct {
-	ActionBase
+	ActionBase  `mapstructure:",squash"`
 	Scheme      string        `mapstructure:"scheme"`
 	Port        uint          `mapstructure:"port"`
 	UrlPath     string        `yaml:"url_path" mapstructure:"url_path"`
@@ -50,7 +51,7 @@ func (a *ValidateAction) validate(ctx context.Context, req *http.Request) error
 	return nil
 }
 
-func (a *ValidateAction) Run(ctx context.Context, conn transport.Connection, _ config.Config) error {
+func (a *ValidateAction) Run(ctx context.Context, conn transport.Connection, _ config.Config, _ *vars.Scope) (Result, error) {
 	host := conn.GetHost()
 	if a.Port != 0 {
 		host = fmt.Sprintf("%s:%d", host, a.Port)
@@ -63,7 +64,7 @@ func (a *ValidateAction) Run(ctx context.Context, conn transport.Connection, _ c
 
 	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
 	if err != nil {
-		return fmt.Errorf("failed to create http request: %s", err)
+		return Result{}, fmt.Errorf("failed to create http request: %s", err)
 	}
 
 	// Try to run and validate the request several times
@@ -74,9 +75,9 @@ func (a *ValidateAction) Run(ctx context.Context, conn transport.Connection, _ c
 	for i := 0; i < retries; i++ {
 		err = a.validate(ctx, req)
 		if err == nil {
-			return nil
+			return resultFor(false), nil
 		}
 	}
 
-	return fmt.Errorf("failed to validate %q after %d retries: %s", u.String(), a.Retries, err)
+	return Result{}, fmt.Errorf("failed to validate %q after %d retries: %s", u.String(), a.Retries, err)
 }
@@ -2,6 +2,7 @@ package actions
 
 import (
 	"context"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -19,7 +20,10 @@ type dummyConnection struct {
 }
 
 func (*dummyConnection) Close() error { return nil }
-func (*dummyConnection) Exec(context.Context, bool, transport.ExecCallbackFunc) error {
+func (*dummyConnection) Exec(context.Context, bool, transport.ExecCallbackFunc) (*transport.Result, error) {
+	return &transport.Result{}, nil
+}
+func (*dummyConnection) CopyFile(context.Context, io.Reader, int64, string, string) error {
 	return nil
 }
 func (*dummyConnection) GetAddress() string { return "" }
@@ -62,21 +66,21 @@ func Test_Run(t *testing.T) {
 		}
 
 		Convey("should be successful under normal conditions", func() {
-			err := action.Run(context.Background(), conn, config.Config{})
+			_, err := action.Run(context.Background(), conn, config.Config{}, nil)
 			So(err, ShouldBeNil)
 			So(executedRetries, ShouldEqual, 1)
 		})
 
 		Convey("should fail when the URL scheme is invalid", func() {
 			action.Scheme = ":"
-			err := action.Run(context.Background(), conn, config.Config{})
+			_, err := action.Run(context.Background(), conn, config.Config{}, nil)
 			So(err.Error(), ShouldContainSubstring, "failed to create http request")
 		})
 
 		Convey("should fail when the retries are exhausted", func() {
 			returnError = true
 			action.Retries = 2
-			err := action.Run(context.Background(), conn, config.Config{})
+			_, err := action.Run(context.Background(), conn, config.Config{}, nil)
 			So(err.Error(), ShouldContainSubstring, "expected status 200 but got 500 instead")
 			So(executedRetries, ShouldEqual, 2)
 		})
@@ -1,24 +1,96 @@
 package config
 
 import (
+	"fmt"
+	"io/ioutil"
 	"log"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/mihaitodor/wormhole/vars"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Host key checking policies
+const (
+	// HostKeyCheckingStrict rejects hosts which are not in known_hosts
+	HostKeyCheckingStrict = "strict"
+	// HostKeyCheckingAcceptNew adds unknown hosts to known_hosts on first use
+	HostKeyCheckingAcceptNew = "accept-new"
+	// HostKeyCheckingOff disables host key verification
+	HostKeyCheckingOff = "off"
+)
+
+// Commands
+const (
+	CommandRun                = "run"
+	CommandVaultEncrypt       = "vault encrypt"
+	CommandVaultEncryptString = "vault encrypt-string"
+	CommandVaultDecrypt       = "vault decrypt"
+	CommandVaultEdit          = "vault edit"
+	CommandVaultRekey         = "vault rekey"
 )
 
 type Config struct {
+	// Command is the selected command, such as `run` or `vault encrypt`
+	Command                  string
 	Playbook                 string
 	PlaybookFolder           string
 	Inventory                string
 	ConnectTimeout           time.Duration
 	ExecTimeout              time.Duration
 	MaxConcurrentConnections int
+	HostKeyChecking          string
+	KnownHostsFile           string
+	Verbose                  bool
+	// ExtraVars take precedence over all the other variables
+	ExtraVars vars.Vars
+	// Limit is a host pattern which further restricts the hosts of the
+	// playbook
+	Limit     string
+	ListHosts bool
+	// Check only reports what the playbook would change
+	Check bool
+	// Diff prints the changes to the contents of files
+	Diff bool
+	// AskPass prompts for the password of the servers which don't have one
+	AskPass bool
+	// VaultPasswordFile and AskVaultPass supply the vault password
+	VaultPasswordFile string
+	AskVaultPass      bool
+	Vault             VaultConfig
+}
+
+// VaultConfig holds the arguments of the vault commands
+type VaultConfig struct {
+	Files []string
+	// Value and Name are the value encrypted by `vault encrypt-string`
+	// and the optional name of the variable which holds it
+	Value string
+	Name  string
+	// NewPasswordFile supplies the new password for `vault rekey`
+	NewPasswordFile string
 }
 
 func NewConfing() Config {
-	playbook := kingpin.Arg("playbook", "Playbook file.").Required().String()
+	run := kingpin.Command("run", "Run a playbook (default).").Default()
+	playbook := run.Arg("playbook", "Playbook file.").Required().String()
+
+	vaultCmd := kingpin.Command("vault", "Manage vault encrypted files and values.")
+	vaultEncrypt := vaultCmd.Command("encrypt", "Encrypt files in place.")
+	vaultEncryptFiles := vaultEncrypt.Arg("files", "Files to encrypt.").Required().ExistingFiles()
+	vaultEncryptString := vaultCmd.Command("encrypt-string", "Encrypt a value for use in Yaml files.")
+	vaultValue := vaultEncryptString.Arg("value", "Value to encrypt.").Required().String()
+	vaultName := vaultEncryptString.Flag("name", "Name of the variable which holds the value.").String()
+	vaultDecrypt := vaultCmd.Command("decrypt", "Decrypt files in place.")
+	vaultDecryptFiles := vaultDecrypt.Arg("files", "Files to decrypt.").Required().ExistingFiles()
+	vaultEdit := vaultCmd.Command("edit", "Edit an encrypted file with $EDITOR.")
+	vaultEditFile := vaultEdit.Arg("file", "File to edit.").Required().ExistingFile()
+	vaultRekey := vaultCmd.Command("rekey", "Change the password of encrypted files.")
+	vaultRekeyFiles := vaultRekey.Arg("files", "Files to rekey.").Required().ExistingFiles()
+	vaultNewPasswordFile := vaultRekey.Flag("new-vault-password-file", "New vault password file.").String()
 
 	inventory := kingpin.Flag("inventory", "Inventory file.").
 		Short('i').Default("inventory.yaml").String()
@@ -27,23 +99,120 @@ func NewConfing() Config {
 		Short('c').Default("5s").Duration()
 
 	execTimeout := kingpin.Flag("exec-timeout", "Execution timeout.").
-		Short('e').Default("5m").Duration()
+		Short('t').Default("5m").Duration()
+
+	extraVars := kingpin.Flag("extra-vars", "Extra variables as key=value or @file.yaml (repeatable).").
+		Short('e').Strings()
 
 	maxConcurrentConnections := kingpin.Flag("max-concurrent-connections", "Max concurrent connections.").
 		Short('m').Default("2").Uint()
 
-	kingpin.Parse()
+	hostKeyChecking := kingpin.Flag("host-key-checking", "Host key checking policy (strict, accept-new or off).").
+		Default(HostKeyCheckingAcceptNew).
+		Enum(HostKeyCheckingStrict, HostKeyCheckingAcceptNew, HostKeyCheckingOff)
+
+	knownHostsFile := kingpin.Flag("known-hosts", "Known hosts file.").
+		Default("~/.ssh/known_hosts").String()
+
+	verbose := kingpin.Flag("verbose", "Print the output of remote commands.").
+		Short('v').Bool()
+
+	limit := kingpin.Flag("limit", "Only run on the hosts matching this pattern.").
+		Short('l').String()
+
+	listHosts := kingpin.Flag("list-hosts", "List the hosts on which the playbook would run and exit.").
+		Bool()
+
+	check := kingpin.Flag("check", "Report what would change without changing anything.").
+		Short('C').Bool()
+
+	diff := kingpin.Flag("diff", "Print the changes to the contents of files.").
+		Short('D').Bool()
+
+	askPass := kingpin.Flag("ask-pass", "Prompt for the password of the servers which don't have one.").
+		Short('k').Bool()
+
+	vaultPasswordFile := kingpin.Flag("vault-password-file", "Vault password file.").String()
+
+	askVaultPass := kingpin.Flag("ask-vault-pass", "Prompt for the vault password.").Bool()
+
+	command := kingpin.Parse()
 
 	if *maxConcurrentConnections == 0 {
 		log.Fatal("Max concurrent connections needs to be greater than 0")
 	}
 
+	parsedExtraVars, err := ParseExtraVars(*extraVars)
+	if err != nil {
+		log.Fatalf("Failed to parse extra vars: %s", err)
+	}
+
+	vaultConfig := VaultConfig{
+		Value:           *vaultValue,
+		Name:            *vaultName,
+		NewPasswordFile: *vaultNewPasswordFile,
+	}
+	switch command {
+	case CommandVaultEncrypt:
+		vaultConfig.Files = *vaultEncryptFiles
+	case CommandVaultDecrypt:
+		vaultConfig.Files = *vaultDecryptFiles
+	case CommandVaultEdit:
+		vaultConfig.Files = []string{*vaultEditFile}
+	case CommandVaultRekey:
+		vaultConfig.Files = *vaultRekeyFiles
+	}
+
 	return Config{
+		Command:                  command,
 		Playbook:                 *playbook,
 		PlaybookFolder:           filepath.Dir(*playbook),
 		Inventory:                *inventory,
 		ConnectTimeout:           *connectTimeout,
 		ExecTimeout:              *execTimeout,
 		MaxConcurrentConnections: int(*maxConcurrentConnections),
+		HostKeyChecking:          *hostKeyChecking,
+		KnownHostsFile:           *knownHostsFile,
+		Verbose:                  *verbose,
+		ExtraVars:                parsedExtraVars,
+		Limit:                    *limit,
+		ListHosts:                *listHosts,
+		Check:                    *check,
+		Diff:                     *diff,
+		AskPass:                  *askPass,
+		VaultPasswordFile:        *vaultPasswordFile,
+		AskVaultPass:             *askVaultPass,
+		Vault:                    vaultConfig,
 	}
 }
+
+// ParseExtraVars parses `key=value` pairs and `@file.yaml` references to
+// files containing a mapping of variables. Later definitions win.
+func ParseExtraVars(args []string) (vars.Vars, error) {
+	extraVars := make(vars.Vars)
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "@") {
+			fileContents, err := ioutil.ReadFile(arg[1:])
+			if err != nil {
+				return nil, fmt.Errorf("failed to open extra vars file: %s", err)
+			}
+
+			var fileVars vars.Vars
+			err = yaml.Unmarshal(fileContents, &fileVars)
+			if err != nil {
+				return nil, fmt.Errorf("failed to unmarshal extra vars file %q: %s", arg[1:], err)
+			}
+
+			extraVars = vars.Merge(extraVars, fileVars)
+			continue
+		}
+
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid extra var %q, expected key=value or @file.yaml", arg)
+		}
+		extraVars[parts[0]] = parts[1]
+	}
+
+	return extraVars, nil
+}
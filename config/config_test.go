@@ -0,0 +1,42 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/mihaitodor/wormhole/vars"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ParseExtraVars(t *testing.T) {
+	Convey("ParseExtraVars()", t, func() {
+		Convey("should parse key=value pairs and files", func() {
+			extraVars, err := ParseExtraVars([]string{
+				"ring=gold", "@fixtures/extra_vars.yaml", "motto=one=all",
+			})
+			So(err, ShouldBeNil)
+			So(extraVars, ShouldResemble, vars.Vars{
+				"ring":    "the one",
+				"bearers": []interface{}{"frodo", "sam"},
+				"motto":   "one=all",
+			})
+		})
+
+		Convey("should let later definitions win", func() {
+			extraVars, err := ParseExtraVars([]string{"@fixtures/extra_vars.yaml", "ring=gold"})
+			So(err, ShouldBeNil)
+			So(extraVars["ring"], ShouldEqual, "gold")
+		})
+
+		Convey("should fail for invalid pairs", func() {
+			_, err := ParseExtraVars([]string{"ring"})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, `invalid extra var "ring"`)
+		})
+
+		Convey("should fail for missing files", func() {
+			_, err := ParseExtraVars([]string{"@fixtures/mordor.yaml"})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "failed to open extra vars file")
+		})
+	})
+}
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// stdin is shared between prompts, since it buffers the input when it's not
+// a terminal
+var stdin = bufio.NewReader(os.Stdin)
+
+// PromptPassword prints the prompt to stderr and reads a password from stdin
+// without echoing it if stdin is a terminal
+func PromptPassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		password, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("failed to read password: %s", err)
+		}
+
+		return string(password), nil
+	}
+
+	password, err := stdin.ReadString('\n')
+	if err != nil && (err != io.EOF || password == "") {
+		return "", fmt.Errorf("failed to read password: %s", err)
+	}
+
+	return strings.TrimRight(password, "\r\n"), nil
+}
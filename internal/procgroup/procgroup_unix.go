@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+// Package procgroup runs commands in their own process group, so they can be
+// killed along with all their children
+package procgroup
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Set runs the command in its own process group
+func Set(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Kill kills the command and all its children
+func Kill(cmd *exec.Cmd) error {
+	err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	if err == syscall.ESRCH {
+		// The process has already finished
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,15 @@
+// Package procgroup runs commands in their own process group, so they can be
+// killed along with all their children
+package procgroup
+
+import (
+	"os/exec"
+)
+
+// Set is not supported on Windows
+func Set(*exec.Cmd) {}
+
+// Kill only kills the command on Windows
+func Kill(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
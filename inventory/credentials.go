@@ -0,0 +1,124 @@
+package inventory
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// CredentialSource reads a credential from somewhere else than the
+// inventory. Exactly one of its fields needs to be set.
+type CredentialSource struct {
+	// Env is the name of an environment variable
+	Env string
+	// File is the path of a file. Trailing newlines are ignored.
+	File string
+	// Command is a shell command which prints the credential to stdout.
+	// Trailing newlines are ignored.
+	Command string
+}
+
+// resolve returns the credential
+func (c *CredentialSource) resolve() (string, error) {
+	switch {
+	case c.Env != "" && c.File == "" && c.Command == "":
+		value, ok := os.LookupEnv(c.Env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %q is not set", c.Env)
+		}
+		return value, nil
+	case c.File != "" && c.Env == "" && c.Command == "":
+		path, err := ExpandHome(c.File)
+		if err != nil {
+			return "", err
+		}
+
+		value, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read file: %s", err)
+		}
+		return strings.TrimRight(string(value), "\r\n"), nil
+	case c.Command != "" && c.Env == "" && c.File == "":
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command("/bin/sh", "-c", c.Command)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+
+		err := cmd.Run()
+		if err != nil {
+			return "", fmt.Errorf("failed to run command %q: %s%s", c.Command, err, stderrDetails(stderr))
+		}
+		return strings.TrimRight(stdout.String(), "\r\n"), nil
+	default:
+		return "", fmt.Errorf("credential source needs exactly one of env, file or command")
+	}
+}
+
+// ResolveCredentials reads the credentials of the servers and of their jump
+// hosts which have a source and aren't set already. Each source is only read
+// once, so the same command doesn't run again for every server.
+func (i Inventory) ResolveCredentials() error {
+	cache := make(map[CredentialSource]string)
+	for _, s := range i {
+		err := s.resolveCredentials(cache)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolveCredentials reads the credentials of the server and of its jump
+// hosts, unless the cache already contains the values of their sources
+func (s *Server) resolveCredentials(cache map[CredentialSource]string) error {
+	credentials := []struct {
+		name   string
+		value  *string
+		source *CredentialSource
+	}{
+		{"password", &s.Password, s.PasswordFrom},
+		{"passphrase", &s.Passphrase, s.PassphraseFrom},
+		{"become password", &s.BecomePassword, s.BecomePasswordFrom},
+	}
+
+	for _, c := range credentials {
+		if *c.value != "" || c.source == nil {
+			continue
+		}
+
+		value, ok := cache[*c.source]
+		if !ok {
+			var err error
+			value, err = c.source.resolve()
+			if err != nil {
+				return fmt.Errorf("failed to read %s of %q: %s", c.name, s.GetAddress(), err)
+			}
+			cache[*c.source] = value
+		}
+		*c.value = value
+	}
+
+	for _, jumpHost := range s.Jump {
+		err := jumpHost.resolveCredentials(cache)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetDefaultPassword sets the password of the servers and jump hosts which
+// don't have a password or a password source
+func (i Inventory) SetDefaultPassword(password string) {
+	for _, s := range i {
+		if s.Password == "" && s.PasswordFrom == nil {
+			s.Password = password
+		}
+		Inventory(s.Jump).SetDefaultPassword(password)
+	}
+}
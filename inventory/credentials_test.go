@@ -0,0 +1,100 @@
+package inventory
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ResolveCredentials(t *testing.T) {
+	Convey("Inventory.ResolveCredentials()", t, func() {
+		So(os.Setenv("WORMHOLE_TEST_PASSWORD", "denethor"), ShouldBeNil)
+		Reset(func() {
+			So(os.Unsetenv("WORMHOLE_TEST_PASSWORD"), ShouldBeNil)
+		})
+
+		Convey("should read the credentials from their sources", func() {
+			i, err := NewInventory("fixtures/inventory_credentials.yaml", nil)
+			So(err, ShouldBeNil)
+			So(i[0].Password, ShouldBeEmpty)
+
+			So(i.ResolveCredentials(), ShouldBeNil)
+			So(i[0].Password, ShouldEqual, "denethor")
+			So(i[0].Passphrase, ShouldEqual, "white tree")
+			So(i[0].BecomePassword, ShouldEqual, "palantir")
+			So(i[0].Jump[0].Password, ShouldEqual, "anduin")
+		})
+
+		Convey("should read each source only once", func() {
+			counter, err := ioutil.TempFile("", "wormhole_credentials")
+			So(err, ShouldBeNil)
+			So(counter.Close(), ShouldBeNil)
+			Reset(func() { So(os.Remove(counter.Name()), ShouldBeNil) })
+
+			source := CredentialSource{Command: "echo read >> " + counter.Name() + "; echo mellon"}
+			sameSource := source
+			i := Inventory{
+				{Host: "minas-tirith", PasswordFrom: &source, Jump: []*Server{{Host: "osgiliath", PasswordFrom: &sameSource}}},
+				{Host: "edoras", PasswordFrom: &sameSource, BecomePasswordFrom: &source},
+			}
+			So(i.ResolveCredentials(), ShouldBeNil)
+			So(i[0].Password, ShouldEqual, "mellon")
+			So(i[0].Jump[0].Password, ShouldEqual, "mellon")
+			So(i[1].Password, ShouldEqual, "mellon")
+			So(i[1].BecomePassword, ShouldEqual, "mellon")
+
+			reads, err := ioutil.ReadFile(counter.Name())
+			So(err, ShouldBeNil)
+			So(string(reads), ShouldEqual, "read\n")
+		})
+
+		Convey("should keep credentials which are already set", func() {
+			s := &Server{Host: "minas-tirith", Password: "mellon", PasswordFrom: &CredentialSource{Env: "WORMHOLE_TEST_PASSWORD"}}
+			So(Inventory{s}.ResolveCredentials(), ShouldBeNil)
+			So(s.Password, ShouldEqual, "mellon")
+		})
+
+		Convey("should fail for missing environment variables", func() {
+			s := &Server{Host: "minas-tirith", PasswordFrom: &CredentialSource{Env: "WORMHOLE_TEST_MISSING"}}
+			err := Inventory{s}.ResolveCredentials()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, `failed to read password of "minas-tirith:22"`)
+			So(err.Error(), ShouldContainSubstring, `environment variable "WORMHOLE_TEST_MISSING" is not set`)
+		})
+
+		Convey("should fail with the stderr of failing commands", func() {
+			s := &Server{Host: "minas-tirith", BecomePasswordFrom: &CredentialSource{Command: "echo 'vault is sealed' >&2; exit 1"}}
+			err := Inventory{s}.ResolveCredentials()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "failed to read become password")
+			So(err.Error(), ShouldContainSubstring, "stderr: vault is sealed")
+		})
+
+		Convey("should fail for ambiguous sources", func() {
+			s := &Server{Host: "minas-tirith", PasswordFrom: &CredentialSource{Env: "A", File: "b"}}
+			err := Inventory{s}.ResolveCredentials()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "exactly one of env, file or command")
+		})
+	})
+}
+
+func Test_SetDefaultPassword(t *testing.T) {
+	Convey("Inventory.SetDefaultPassword()", t, func() {
+		i := Inventory{
+			{Host: "minas-tirith", Jump: []*Server{{Host: "osgiliath"}}},
+			{Host: "edoras", Password: "mellon"},
+			{Host: "isengard", PasswordFrom: &CredentialSource{Env: "SARUMAN"}},
+		}
+
+		Convey("should only set the missing passwords", func() {
+			i.SetDefaultPassword("friend")
+			So(i[0].Password, ShouldEqual, "friend")
+			So(i[0].Jump[0].Password, ShouldEqual, "friend")
+			So(i[1].Password, ShouldEqual, "mellon")
+			So(i[2].Password, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,3 @@
+#!/bin/sh
+echo "the palantir is clouded" >&2
+exit 3
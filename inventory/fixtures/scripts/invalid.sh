@@ -0,0 +1,3 @@
+#!/bin/sh
+echo "- host: not json"
+echo "warning: emitting yaml" >&2
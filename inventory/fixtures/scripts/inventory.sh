@@ -0,0 +1,13 @@
+#!/bin/sh
+# Prints a dynamic inventory, like a CMDB export would
+cat <<'JSON'
+{
+  "groups": {
+    "gondor": {"username": "isildur", "vars": {"realm": "gondor"}}
+  },
+  "servers": [
+    {"host": "minas-tirith", "port": 2222, "groups": ["gondor"], "vars": {"steward": "denethor"}},
+    {"host": "beacon[1:2].gondor", "groups": ["gondor"]}
+  ]
+}
+JSON
@@ -3,20 +3,97 @@ package inventory
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
 
+	"github.com/mihaitodor/wormhole/vars"
+	"github.com/mihaitodor/wormhole/vault"
 	yaml "gopkg.in/yaml.v2"
 )
 
+// Connection types
+const (
+	// ConnectionSSH connects to the server via ssh (default)
+	ConnectionSSH = "ssh"
+	// ConnectionLocal runs everything on the current machine
+	ConnectionLocal = "local"
+	// ConnectionDocker runs everything inside a container via the docker CLI
+	ConnectionDocker = "docker"
+)
+
 type Server struct {
-	Host        string
-	Port        uint
-	Username    string
-	Password    string
+	// Name is matched by host patterns instead of the host, if set
+	Name string
+	// Connection selects the transport used to reach the server
+	Connection string
+	// Container is the name or ID of the container for docker connections
+	Container string
+	Host      string
+	Port      uint
+	Username  string
+	Password  string
+	// PrivateKey is the path to a private key file used for public key
+	// authentication. Passphrase is only needed for encrypted keys.
+	PrivateKey string `yaml:"private_key"`
+	Passphrase string
+	// BecomePassword is the password used for privilege escalation
+	BecomePassword string `yaml:"become_password"`
+	// The credentials can also be read from other sources when connecting
+	// to the server, if they are not set
+	PasswordFrom       *CredentialSource `yaml:"password_from"`
+	PassphraseFrom     *CredentialSource `yaml:"passphrase_from"`
+	BecomePasswordFrom *CredentialSource `yaml:"become_password_from"`
+	// Jump is the list of bastion hosts through which the connection to
+	// this server is tunnelled, in the order in which they are traversed
+	Jump []*Server
+	// Groups are the names of the inventory groups this server belongs to
+	Groups []string
+	// Vars are the variables of this server, available to the playbook.
+	// Once the inventory is loaded, they also contain the group variables.
+	Vars vars.Vars
+	// memberOf contains all the groups of this server, including the
+	// parents of the groups it lists
+	memberOf    map[string]bool
 	playbookErr error
 	finished    bool
 }
 
+// GetName returns the name by which the server is matched in host patterns
+func (s *Server) GetName() string {
+	if s.Name != "" {
+		return s.Name
+	}
+
+	if s.Connection == ConnectionDocker {
+		return s.Container
+	}
+
+	if s.Connection == ConnectionLocal && s.Host == "" {
+		return "localhost"
+	}
+
+	return s.Host
+}
+
+// InGroup returns true if the server belongs to the given group, either
+// directly or via one of its child groups
+func (s *Server) InGroup(name string) bool {
+	return name == GroupAll || s.memberOf[name]
+}
+
 func (s *Server) GetAddress() string {
+	if s.Connection == ConnectionLocal {
+		if s.Host == "" {
+			return "localhost"
+		}
+		return s.Host
+	}
+
+	if s.Connection == ConnectionDocker {
+		return "docker:" + s.Container
+	}
+
 	address := s.Host + ":22"
 	if s.Port != 0 {
 		address = fmt.Sprintf("%s:%d", s.Host, s.Port)
@@ -36,6 +113,29 @@ func (s *Server) MarkFinished() {
 	s.finished = true
 }
 
+// GroupAll is the implicit group to which all servers belong
+const GroupAll = "all"
+
+// Group holds the settings shared by the servers which belong to it. The
+// connection settings are defaults for servers which don't set them.
+type Group struct {
+	// Children are the names of the groups nested in this group. Servers
+	// which belong to a child group also belong to this group.
+	Children           []string
+	Connection         string
+	Port               uint
+	Username           string
+	Password           string
+	PrivateKey         string `yaml:"private_key"`
+	Passphrase         string
+	BecomePassword     string            `yaml:"become_password"`
+	PasswordFrom       *CredentialSource `yaml:"password_from"`
+	PassphraseFrom     *CredentialSource `yaml:"passphrase_from"`
+	BecomePasswordFrom *CredentialSource `yaml:"become_password_from"`
+	Jump               []*Server
+	Vars               vars.Vars
+}
+
 type Inventory []*Server
 
 func (i Inventory) GetAllServers(predFn func(*Server) bool) []string {
@@ -71,17 +171,284 @@ func (i Inventory) GetAllFailedServers() []string {
 	})
 }
 
-func NewInventory(inventoryFile string) (Inventory, error) {
+// NewInventory loads the inventory from either a plain sequence of servers
+// or a mapping with the `groups` and the `servers`. If inventoryFile is an
+// executable script, the inventory is read from the JSON which it prints
+// instead. Contents encrypted with the vault are decrypted with v, which can
+// be nil if no vault password was supplied. Servers whose host contains
+// ranges are expanded into one server for each host.
+func NewInventory(inventoryFile string, v *vault.Vault) (Inventory, error) {
+	info, err := os.Stat(inventoryFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open inventory file: %s", err)
+	}
+
 	fileContents, err := ioutil.ReadFile(inventoryFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open inventory file: %s", err)
 	}
 
-	var inventory Inventory
-	err = yaml.Unmarshal(fileContents, &inventory)
+	if info.Mode()&0111 != 0 && isInventoryScript(inventoryFile, fileContents) {
+		contents, err := runInventoryScript(inventoryFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return parseInventory(contents, filepath.Dir(inventoryFile), v)
+	}
+
+	return parseInventory(fileContents, filepath.Dir(inventoryFile), v)
+}
+
+// parseInventory parses the inventory contents. Relative paths of inventory
+// sources are resolved from dir.
+func parseInventory(fileContents []byte, dir string, v *vault.Vault) (Inventory, error) {
+	fileContents, err := v.DecryptYAML(fileContents)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt inventory contents: %s", err)
+	}
+
+	var rawInventory interface{}
+	err = yaml.Unmarshal(fileContents, &rawInventory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal inventory contents: %s", err)
+	}
+
+	var inventory struct {
+		Groups  map[string]*Group
+		Servers Inventory
+		Sources []Source
+	}
+	if _, ok := rawInventory.([]interface{}); ok {
+		err = yaml.Unmarshal(fileContents, &inventory.Servers)
+	} else {
+		err = yaml.Unmarshal(fileContents, &inventory)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal inventory contents: %s", err)
 	}
 
-	return inventory, nil
+	servers, err := expandServers(inventory.Servers)
+	if err != nil {
+		return nil, err
+	}
+
+	var sshConfigServers Inventory
+	for _, src := range inventory.Sources {
+		imported, generatedGroups, err := src.load(dir)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, imported...)
+		if src.SSHConfig != nil {
+			sshConfigServers = append(sshConfigServers, imported...)
+		}
+
+		if inventory.Groups == nil {
+			inventory.Groups = make(map[string]*Group)
+		}
+		for _, name := range generatedGroups {
+			if _, ok := inventory.Groups[name]; !ok {
+				inventory.Groups[name] = &Group{}
+			}
+		}
+	}
+
+	err = applyGroups(servers, inventory.Groups)
+	if err != nil {
+		return nil, err
+	}
+
+	err = defaultToCurrentUser(sshConfigServers)
+	if err != nil {
+		return nil, err
+	}
+
+	return servers, nil
+}
+
+// applyGroups resolves the groups of each server and applies their
+// settings. Child groups take precedence over their parents and, at the same
+// level of nesting, groups listed later by the server take precedence. The
+// server settings take precedence over all of them.
+func applyGroups(servers Inventory, groups map[string]*Group) error {
+	for name, group := range groups {
+		if group == nil {
+			groups[name] = &Group{}
+		}
+	}
+
+	parents, err := groupParents(groups)
+	if err != nil {
+		return err
+	}
+
+	depths, err := groupDepths(groups, parents)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range servers {
+		memberOf, err := serverGroups(s, groups, parents, depths)
+		if err != nil {
+			return err
+		}
+
+		s.memberOf = make(map[string]bool, len(memberOf))
+		for _, name := range memberOf {
+			s.memberOf[name] = true
+		}
+
+		// Apply the most specific groups first, so only the unset settings
+		// are taken from the less specific ones
+		for i := len(memberOf) - 1; i >= 0; i-- {
+			s.applyDefaults(groups[memberOf[i]])
+		}
+
+		var all []vars.Vars
+		for _, name := range memberOf {
+			all = append(all, groups[name].Vars)
+		}
+
+		if len(all) > 0 {
+			s.Vars = vars.Merge(append(all, s.Vars)...)
+		}
+	}
+
+	return nil
+}
+
+// groupParents returns the names of the parents of each group
+func groupParents(groups map[string]*Group) (map[string][]string, error) {
+	parents := make(map[string][]string)
+	for name, group := range groups {
+		for _, child := range group.Children {
+			if _, ok := groups[child]; !ok {
+				return nil, fmt.Errorf("group %q references unknown child group %q", name, child)
+			}
+			if child == GroupAll {
+				return nil, fmt.Errorf("group %q can't contain the %q group", name, GroupAll)
+			}
+			parents[child] = append(parents[child], name)
+		}
+	}
+
+	// Keep the precedence of the groups deterministic
+	for _, p := range parents {
+		sort.Strings(p)
+	}
+
+	return parents, nil
+}
+
+// groupDepths returns the nesting level of each group, where groups without
+// parents are at level 0. It fails if the groups contain cycles.
+func groupDepths(groups map[string]*Group, parents map[string][]string) (map[string]int, error) {
+	depths := make(map[string]int, len(groups))
+	visiting := make(map[string]bool)
+	var depth func(name string) (int, error)
+	depth = func(name string) (int, error) {
+		if d, ok := depths[name]; ok {
+			return d, nil
+		}
+		if visiting[name] {
+			return 0, fmt.Errorf("group %q is nested in itself", name)
+		}
+		visiting[name] = true
+
+		d := 0
+		if name != GroupAll {
+			// The all group, if defined, is the parent of every group
+			if _, ok := groups[GroupAll]; ok {
+				d = 1
+			}
+		}
+		for _, parent := range parents[name] {
+			parentDepth, err := depth(parent)
+			if err != nil {
+				return 0, err
+			}
+			if parentDepth+1 > d {
+				d = parentDepth + 1
+			}
+		}
+
+		depths[name] = d
+		return d, nil
+	}
+
+	for name := range groups {
+		_, err := depth(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return depths, nil
+}
+
+// serverGroups returns all the groups of the server, including the parents
+// of the groups it lists, from the least to the most specific
+func serverGroups(s *Server, groups map[string]*Group, parents map[string][]string, depths map[string]int) ([]string, error) {
+	var memberOf []string
+	seen := make(map[string]bool)
+	var add func(name string)
+	add = func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		for _, parent := range parents[name] {
+			add(parent)
+		}
+		memberOf = append(memberOf, name)
+	}
+
+	if _, ok := groups[GroupAll]; ok {
+		add(GroupAll)
+	}
+	for _, name := range s.Groups {
+		if name == GroupAll {
+			continue
+		}
+		if _, ok := groups[name]; !ok {
+			return nil, fmt.Errorf("server %q references unknown group %q", s.GetAddress(), name)
+		}
+		add(name)
+	}
+
+	sort.SliceStable(memberOf, func(i, j int) bool {
+		return depths[memberOf[i]] < depths[memberOf[j]]
+	})
+
+	return memberOf, nil
+}
+
+// applyDefaults sets the connection settings of the group on the server if
+// they are not set already
+func (s *Server) applyDefaults(g *Group) {
+	if s.Connection == "" {
+		s.Connection = g.Connection
+	}
+	if s.Port == 0 {
+		s.Port = g.Port
+	}
+	if s.Username == "" {
+		s.Username = g.Username
+	}
+	if s.Password == "" && s.PasswordFrom == nil {
+		s.Password, s.PasswordFrom = g.Password, g.PasswordFrom
+	}
+	if s.PrivateKey == "" {
+		s.PrivateKey = g.PrivateKey
+	}
+	if s.Passphrase == "" && s.PassphraseFrom == nil {
+		s.Passphrase, s.PassphraseFrom = g.Passphrase, g.PassphraseFrom
+	}
+	if s.BecomePassword == "" && s.BecomePasswordFrom == nil {
+		s.BecomePassword, s.BecomePasswordFrom = g.BecomePassword, g.BecomePasswordFrom
+	}
+	if len(s.Jump) == 0 {
+		s.Jump = g.Jump
+	}
 }
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"testing"
 
+	"github.com/mihaitodor/wormhole/vars"
+	"github.com/mihaitodor/wormhole/vault"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -70,15 +72,147 @@ func Test_Inventory(t *testing.T) {
 
 func Test_NewInventory(t *testing.T) {
 	Convey("NewInventory()", t, func() {
-		i, err := NewInventory("fixtures/inventory.yaml")
+		i, err := NewInventory("fixtures/inventory.yaml", nil)
 
 		Convey("should run successfully", func() {
 			So(err, ShouldBeNil)
 			So(i, ShouldHaveLength, 2)
 			So(i[0].Host, ShouldEqual, "gondor")
 			So(i[0].Username, ShouldEqual, "isildur")
+			So(i[0].Vars, ShouldResemble, vars.Vars{"steward": "denethor", "beacons": 7})
 			So(i[1].Port, ShouldEqual, 4444)
 			So(i[1].Password, ShouldEqual, "thou shalt not pass")
+			So(i[1].Jump, ShouldHaveLength, 1)
+			So(i[1].Jump[0].Host, ShouldEqual, "minas-morgul")
+			So(i[1].Jump[0].PrivateKey, ShouldEqual, "~/.ssh/nazgul")
+		})
+	})
+}
+
+func Test_NewInventoryWithGroups(t *testing.T) {
+	Convey("NewInventory() with groups", t, func() {
+		Convey("should resolve the groups of each server", func() {
+			i, err := NewInventory("fixtures/inventory_groups.yaml", nil)
+			So(err, ShouldBeNil)
+			So(i, ShouldHaveLength, 3)
+
+			So(i[0].InGroup("gondor"), ShouldBeTrue)
+			So(i[0].InGroup("middle-earth"), ShouldBeTrue)
+			So(i[1].InGroup("gondor"), ShouldBeFalse)
+			So(i[1].InGroup("middle-earth"), ShouldBeTrue)
+			So(i[2].InGroup("middle-earth"), ShouldBeFalse)
+			So(i[2].InGroup(GroupAll), ShouldBeTrue)
+		})
+
+		Convey("should merge the group vars into the server vars", func() {
+			i, err := NewInventory("fixtures/inventory_groups.yaml", nil)
+			So(err, ShouldBeNil)
+			So(i[0].Vars, ShouldResemble, vars.Vars{
+				"age": "third", "realm": "gondor", "king": "theoden", "steward": "boromir",
+			})
+			So(i[1].Vars, ShouldResemble, vars.Vars{"age": "third", "realm": "rohan", "king": "theoden"})
+			So(i[2].Vars, ShouldResemble, vars.Vars{"age": "third"})
+		})
+
+		Convey("should apply the group defaults to the servers", func() {
+			i, err := NewInventory("fixtures/inventory_groups.yaml", nil)
+			So(err, ShouldBeNil)
+			So(i[0].Username, ShouldEqual, "isildur")
+			So(i[0].Port, ShouldEqual, 3333)
+			So(i[0].Password, ShouldEqual, "white tree")
+			So(i[1].Username, ShouldEqual, "ranger")
+			So(i[1].Password, ShouldBeEmpty)
+			So(i[2].Username, ShouldEqual, "ranger")
+			So(i[2].Port, ShouldEqual, 0)
+		})
+
+		Convey("should apply the group jump hosts to the servers", func() {
+			i, err := NewInventory("fixtures/inventory_groups.yaml", nil)
+			So(err, ShouldBeNil)
+			So(i[0].Jump, ShouldHaveLength, 1)
+			So(i[0].Jump[0].Host, ShouldEqual, "pelargir")
+			So(i[1].Jump, ShouldHaveLength, 1)
+			So(i[1].Jump[0].Host, ShouldEqual, "helms-deep")
+			So(i[1].Jump[0].Username, ShouldEqual, "gamling")
+			So(i[2].Jump, ShouldBeEmpty)
+		})
+
+		Convey("should fail for unknown groups", func() {
+			_, err := NewInventory("fixtures/inventory_unknown_group.yaml", nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, `unknown group "mordor"`)
+		})
+
+		Convey("should fail for nesting cycles", func() {
+			_, err := NewInventory("fixtures/inventory_group_cycle.yaml", nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "is nested in itself")
+		})
+	})
+}
+
+func Test_NewInventoryFromScript(t *testing.T) {
+	Convey("NewInventory() with an executable inventory", t, func() {
+		Convey("should load the JSON printed by the script", func() {
+			i, err := NewInventory("fixtures/scripts/inventory.sh", nil)
+			So(err, ShouldBeNil)
+			So(i.GetAllServers(nil), ShouldResemble, []string{
+				"minas-tirith:2222", "beacon1.gondor:22", "beacon2.gondor:22",
+			})
+			So(i[0].Username, ShouldEqual, "isildur")
+			So(i[0].Vars, ShouldResemble, vars.Vars{"realm": "gondor", "steward": "denethor"})
+			So(i[2].InGroup("gondor"), ShouldBeTrue)
+		})
+
+		Convey("should read executable YAML files which aren't scripts", func() {
+			i, err := NewInventory("fixtures/scripts/inventory_executable.yaml", nil)
+			So(err, ShouldBeNil)
+			So(i.GetAllServers(nil), ShouldResemble, []string{"minas-tirith:22"})
+			So(i[0].Username, ShouldEqual, "isildur")
+		})
+
+		Convey("should fail for other executable files which aren't scripts", func() {
+			_, err := NewInventory("fixtures/scripts/inventory_not_a_script", nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "is executable, but it's not a script")
+		})
+
+		Convey("should fail with the stderr of failing scripts", func() {
+			_, err := NewInventory("fixtures/scripts/failing.sh", nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "failed to run inventory script: exit status 3")
+			So(err.Error(), ShouldContainSubstring, "stderr: the palantir is clouded")
+		})
+
+		Convey("should fail with the stderr of scripts printing invalid JSON", func() {
+			_, err := NewInventory("fixtures/scripts/invalid.sh", nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "inventory script printed invalid JSON")
+			So(err.Error(), ShouldContainSubstring, "stderr: warning: emitting yaml")
+		})
+	})
+}
+
+func Test_NewInventoryWithVault(t *testing.T) {
+	Convey("NewInventory() with vault encrypted values", t, func() {
+		Convey("should decrypt the values with the vault password", func() {
+			i, err := NewInventory("fixtures/inventory_vault.yaml", vault.New("speak friend"))
+			So(err, ShouldBeNil)
+			So(i, ShouldHaveLength, 1)
+			So(i[0].Password, ShouldEqual, "thou shalt not pass")
+			So(i[0].Vars, ShouldResemble, vars.Vars{"tower": "barad-dur"})
+		})
+
+		Convey("should fail without the vault password", func() {
+			_, err := NewInventory("fixtures/inventory_vault.yaml", nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "no vault password was supplied")
+		})
+
+		Convey("should fail with the wrong vault password", func() {
+			_, err := NewInventory("fixtures/inventory_vault.yaml", vault.New("mellon"))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "wrong password")
 		})
 	})
 }
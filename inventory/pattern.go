@@ -0,0 +1,114 @@
+package inventory
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Select returns the servers matching the host pattern, in inventory order.
+// The pattern is a list of terms separated by `:` or `,`. Each term is either
+// a group name or a glob matched against the server names. Servers matching
+// any plain term are selected, then terms prefixed with `&` only keep the
+// servers which also match them and terms prefixed with `!` exclude the
+// servers matching them. An empty pattern selects all servers.
+func (i Inventory) Select(pattern string) (Inventory, error) {
+	terms := strings.FieldsFunc(pattern, func(r rune) bool {
+		return r == ':' || r == ','
+	})
+
+	var include, intersect, exclude []string
+	for _, term := range terms {
+		term = strings.TrimSpace(term)
+		switch {
+		case term == "":
+			continue
+		case strings.HasPrefix(term, "&"):
+			intersect = append(intersect, strings.TrimSpace(term[1:]))
+		case strings.HasPrefix(term, "!"):
+			exclude = append(exclude, strings.TrimSpace(term[1:]))
+		default:
+			include = append(include, term)
+		}
+	}
+
+	if len(include) == 0 {
+		include = []string{GroupAll}
+	}
+
+	groups := i.groupNames()
+
+	var selected Inventory
+	for _, s := range i {
+		ok, err := s.matchesAny(include, groups)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, term := range intersect {
+			if !ok {
+				break
+			}
+			ok, err = s.matches(term, groups)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if ok {
+			excluded, err := s.matchesAny(exclude, groups)
+			if err != nil {
+				return nil, err
+			}
+			ok = !excluded
+		}
+
+		if ok {
+			selected = append(selected, s)
+		}
+	}
+
+	return selected, nil
+}
+
+// groupNames returns the names of all the groups which have servers
+func (i Inventory) groupNames() map[string]bool {
+	groups := map[string]bool{GroupAll: true}
+	for _, s := range i {
+		for name := range s.memberOf {
+			groups[name] = true
+		}
+	}
+
+	return groups
+}
+
+func (s *Server) matchesAny(terms []string, groups map[string]bool) (bool, error) {
+	for _, term := range terms {
+		ok, err := s.matches(term, groups)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+
+	return false, nil
+}
+
+// matches checks if the server belongs to the group named by term or if its
+// name matches the glob in term
+func (s *Server) matches(term string, groups map[string]bool) (bool, error) {
+	if term == "" {
+		return false, fmt.Errorf("invalid host pattern: empty term")
+	}
+
+	if groups[term] {
+		return s.InGroup(term), nil
+	}
+
+	ok, err := path.Match(term, s.GetName())
+	if err != nil {
+		return false, fmt.Errorf("invalid host pattern %q: %s", term, err)
+	}
+
+	return ok, nil
+}
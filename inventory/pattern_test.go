@@ -0,0 +1,73 @@
+package inventory
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Select(t *testing.T) {
+	Convey("Inventory.Select()", t, func() {
+		i := Inventory{
+			{Host: "minas-tirith", memberOf: map[string]bool{"gondor": true, "cities": true}},
+			{Host: "osgiliath", memberOf: map[string]bool{"gondor": true}},
+			{Host: "edoras", memberOf: map[string]bool{"rohan": true, "cities": true}},
+			{Connection: ConnectionDocker, Container: "isengard"},
+		}
+
+		names := func(servers Inventory) []string {
+			var names []string
+			for _, s := range servers {
+				names = append(names, s.GetName())
+			}
+			return names
+		}
+
+		Convey("should select all servers for empty patterns", func() {
+			for _, pattern := range []string{"", "all", "*"} {
+				servers, err := i.Select(pattern)
+				So(err, ShouldBeNil)
+				So(servers, ShouldHaveLength, 4)
+			}
+		})
+
+		Convey("should select groups and globs", func() {
+			servers, err := i.Select("rohan,minas-*")
+			So(err, ShouldBeNil)
+			So(names(servers), ShouldResemble, []string{"minas-tirith", "edoras"})
+
+			servers, err = i.Select("isen*")
+			So(err, ShouldBeNil)
+			So(names(servers), ShouldResemble, []string{"isengard"})
+		})
+
+		Convey("should support intersections and exclusions", func() {
+			servers, err := i.Select("gondor:&cities")
+			So(err, ShouldBeNil)
+			So(names(servers), ShouldResemble, []string{"minas-tirith"})
+
+			servers, err = i.Select("all:!gondor")
+			So(err, ShouldBeNil)
+			So(names(servers), ShouldResemble, []string{"edoras", "isengard"})
+
+			servers, err = i.Select("!cities")
+			So(err, ShouldBeNil)
+			So(names(servers), ShouldResemble, []string{"osgiliath", "isengard"})
+		})
+
+		Convey("should not match anything for unknown names", func() {
+			servers, err := i.Select("mordor")
+			So(err, ShouldBeNil)
+			So(servers, ShouldBeEmpty)
+		})
+
+		Convey("should fail for invalid patterns", func() {
+			_, err := i.Select("[minas")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, `invalid host pattern "[minas"`)
+
+			_, err = i.Select("gondor:&")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,164 @@
+package inventory
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mihaitodor/wormhole/vars"
+)
+
+// maxRangeHosts limits the number of hosts a single entry can expand to,
+// which is the size of a /16 network
+const maxRangeHosts = 1 << 16
+
+// expandServers replaces the servers whose host contains ranges with one
+// copy of the server for each host in the ranges
+func expandServers(servers Inventory) (Inventory, error) {
+	var expanded Inventory
+	for _, s := range servers {
+		hosts, err := expandHost(s.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(hosts) == 1 && hosts[0] == s.Host {
+			expanded = append(expanded, s)
+			continue
+		}
+
+		for _, host := range hosts {
+			server := s.clone()
+			server.Host = host
+			expanded = append(expanded, server)
+		}
+	}
+
+	return expanded, nil
+}
+
+// clone returns a copy of the server which doesn't share its jump hosts,
+// groups or variables with the original
+func (s *Server) clone() *Server {
+	server := *s
+
+	server.Jump = nil
+	for _, jumpHost := range s.Jump {
+		server.Jump = append(server.Jump, jumpHost.clone())
+	}
+
+	server.Groups = append([]string(nil), s.Groups...)
+
+	if s.Vars != nil {
+		server.Vars = vars.Merge(s.Vars)
+	}
+
+	return &server
+}
+
+// expandHost returns the hosts described by a host which contains ranges,
+// such as `web[01:40].example.com` or `10.0.[1:3].[10:20]`. Numeric ranges
+// keep the width of the start when it has leading zeros and alphabetic ranges
+// go over single letters, such as `[a:f]`.
+func expandHost(host string) ([]string, error) {
+	start := strings.Index(host, "[")
+	if start == -1 {
+		if strings.Contains(host, "]") {
+			return nil, fmt.Errorf("malformed host range in %q: unexpected ']'", host)
+		}
+		return []string{host}, nil
+	}
+
+	end := strings.Index(host[start:], "]")
+	if end == -1 {
+		return nil, fmt.Errorf("malformed host range in %q: missing ']'", host)
+	}
+	end += start
+
+	prefix := host[:start]
+	if strings.Contains(prefix, "]") {
+		return nil, fmt.Errorf("malformed host range in %q: unexpected ']'", host)
+	}
+
+	items, err := expandRange(host[start+1 : end])
+	if err != nil {
+		return nil, fmt.Errorf("malformed host range in %q: %s", host, err)
+	}
+
+	suffixes, err := expandHost(host[end+1:])
+	if err != nil {
+		return nil, fmt.Errorf("malformed host range in %q: %s", host, err)
+	}
+
+	if uint64(len(items))*uint64(len(suffixes)) > maxRangeHosts {
+		return nil, fmt.Errorf("malformed host range in %q: more than %d hosts", host, maxRangeHosts)
+	}
+
+	var hosts []string
+	for _, item := range items {
+		for _, suffix := range suffixes {
+			hosts = append(hosts, prefix+item+suffix)
+		}
+	}
+
+	return hosts, nil
+}
+
+// expandRange returns the items of a `start:end` range
+func expandRange(r string) ([]string, error) {
+	bounds := strings.Split(r, ":")
+	if len(bounds) != 2 || bounds[0] == "" || bounds[1] == "" {
+		return nil, fmt.Errorf("expected [start:end], got [%s]", r)
+	}
+	first, last := bounds[0], bounds[1]
+
+	if isLetter(first) && isLetter(last) {
+		if isUpper(first[0]) != isUpper(last[0]) {
+			return nil, fmt.Errorf("start %q and end %q have different cases", first, last)
+		}
+		if first[0] > last[0] {
+			return nil, fmt.Errorf("start %q is after end %q", first, last)
+		}
+
+		var items []string
+		for c := first[0]; c <= last[0]; c++ {
+			items = append(items, string(c))
+		}
+		return items, nil
+	}
+
+	from, err := strconv.ParseUint(first, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid range start %q", first)
+	}
+	to, err := strconv.ParseUint(last, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid range end %q", last)
+	}
+	if from > to {
+		return nil, fmt.Errorf("start %q is after end %q", first, last)
+	}
+	if to-from >= maxRangeHosts {
+		return nil, fmt.Errorf("range [%s] has more than %d items", r, maxRangeHosts)
+	}
+
+	format := "%d"
+	if len(first) > 1 && first[0] == '0' {
+		format = fmt.Sprintf("%%0%dd", len(first))
+	}
+
+	var items []string
+	for i := from; i <= to; i++ {
+		items = append(items, fmt.Sprintf(format, i))
+	}
+
+	return items, nil
+}
+
+func isLetter(s string) bool {
+	return len(s) == 1 && (s[0] >= 'a' && s[0] <= 'z' || isUpper(s[0]))
+}
+
+func isUpper(c byte) bool {
+	return c >= 'A' && c <= 'Z'
+}
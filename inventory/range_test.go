@@ -0,0 +1,109 @@
+package inventory
+
+import (
+	"testing"
+
+	"github.com/mihaitodor/wormhole/vars"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_expandHost(t *testing.T) {
+	Convey("expandHost()", t, func() {
+		Convey("should leave hosts without ranges unchanged", func() {
+			hosts, err := expandHost("rivendell")
+			So(err, ShouldBeNil)
+			So(hosts, ShouldResemble, []string{"rivendell"})
+		})
+
+		Convey("should expand numeric ranges and keep leading zeros", func() {
+			hosts, err := expandHost("web[08:11].example.com")
+			So(err, ShouldBeNil)
+			So(hosts, ShouldResemble, []string{
+				"web08.example.com", "web09.example.com", "web10.example.com", "web11.example.com",
+			})
+
+			hosts, err = expandHost("web[9:10]")
+			So(err, ShouldBeNil)
+			So(hosts, ShouldResemble, []string{"web9", "web10"})
+		})
+
+		Convey("should expand multiple ranges", func() {
+			hosts, err := expandHost("10.0.[1:2].[10:11]")
+			So(err, ShouldBeNil)
+			So(hosts, ShouldResemble, []string{"10.0.1.10", "10.0.1.11", "10.0.2.10", "10.0.2.11"})
+		})
+
+		Convey("should expand alphabetic ranges", func() {
+			hosts, err := expandHost("db-[a:c]")
+			So(err, ShouldBeNil)
+			So(hosts, ShouldResemble, []string{"db-a", "db-b", "db-c"})
+		})
+
+		Convey("should reject malformed ranges", func() {
+			for _, host := range []string{
+				"web[01:10", "web01:10]", "web[]", "web[1]", "web[1:2:3]", "web[:3]",
+				"web[a:3]", "web[x:B]", "web[10:01]", "web[c:a]", "web[-1:2]", "web[[1:2]]",
+			} {
+				_, err := expandHost(host)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "malformed host range")
+			}
+		})
+
+		Convey("should reject ranges with too many hosts", func() {
+			_, err := expandHost("10.[0:4000000000]")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "range [0:4000000000] has more than 65536 items")
+
+			_, err = expandHost("10.0.[0:255].[0:255]")
+			So(err, ShouldBeNil)
+
+			_, err = expandHost("10.[0:1].[0:255].[0:255]")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "more than 65536 hosts")
+		})
+	})
+}
+
+func Test_NewInventoryWithRanges(t *testing.T) {
+	Convey("NewInventory() with host ranges", t, func() {
+		Convey("should expand the ranges into servers", func() {
+			i, err := NewInventory("fixtures/inventory_ranges.yaml", nil)
+			So(err, ShouldBeNil)
+			So(i.GetAllServers(nil), ShouldResemble, []string{
+				"beacon08.gondor:22", "beacon09.gondor:22", "beacon10.gondor:22",
+				"10.0.1.a:2222", "10.0.1.b:2222", "10.0.2.a:2222", "10.0.2.b:2222",
+				"rivendell:22",
+			})
+			So(i[1].Username, ShouldEqual, "isildur")
+			So(i[1].Vars, ShouldResemble, vars.Vars{"lit": true})
+		})
+
+		Convey("should not share the jump hosts, groups and vars between the servers", func() {
+			i, err := expandServers(Inventory{{
+				Host:   "beacon[1:2]",
+				Jump:   []*Server{{Host: "osgiliath", Jump: []*Server{{Host: "pelargir"}}}},
+				Groups: []string{"gondor"},
+				Vars:   vars.Vars{"lit": false},
+			}})
+			So(err, ShouldBeNil)
+			So(i, ShouldHaveLength, 2)
+
+			i[0].Jump[0].Password = "mellon"
+			i[0].Jump[0].Jump[0].Password = "mellon"
+			i[0].Groups[0] = "rohan"
+			i[0].Vars["lit"] = true
+
+			So(i[1].Jump[0].Password, ShouldBeEmpty)
+			So(i[1].Jump[0].Jump[0].Password, ShouldBeEmpty)
+			So(i[1].Groups, ShouldResemble, []string{"gondor"})
+			So(i[1].Vars, ShouldResemble, vars.Vars{"lit": false})
+		})
+
+		Convey("should fail for malformed ranges", func() {
+			_, err := NewInventory("fixtures/inventory_invalid_range.yaml", nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, `malformed host range in "beacon[10:08].gondor"`)
+		})
+	})
+}
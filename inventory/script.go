@@ -0,0 +1,71 @@
+package inventory
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// isInventoryScript checks if an executable inventory file should be run.
+// Files which start with `#!` are always run, but YAML files are read as they
+// are otherwise, since some filesystems mark all the files as executable.
+func isInventoryScript(path string, contents []byte) bool {
+	if bytes.HasPrefix(contents, []byte("#!")) {
+		return true
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		return false
+	default:
+		return true
+	}
+}
+
+// runInventoryScript runs an executable inventory and returns the JSON which
+// it prints. The JSON has the same schema as the inventory file, so it is
+// either a list of servers or an object with the `groups` and the `servers`.
+func runInventoryScript(script string) ([]byte, error) {
+	path, err := filepath.Abs(script)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve inventory script path: %s", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(path)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.ENOEXEC {
+		return nil, fmt.Errorf(
+			"inventory file %q is executable, but it's not a script:"+
+				" add a #! line, a .yaml extension or remove its executable bit", script,
+		)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to run inventory script: %s%s", err, stderrDetails(stderr))
+	}
+
+	var rawInventory interface{}
+	err = json.Unmarshal(stdout.Bytes(), &rawInventory)
+	if err != nil {
+		return nil, fmt.Errorf("inventory script printed invalid JSON: %s%s", err, stderrDetails(stderr))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+func stderrDetails(stderr bytes.Buffer) string {
+	details := strings.TrimSpace(stderr.String())
+	if details == "" {
+		return ""
+	}
+
+	return "\nstderr: " + details
+}
@@ -0,0 +1,44 @@
+package inventory
+
+import (
+	"fmt"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// Source imports servers into the inventory from other systems. Exactly one
+// of its fields needs to be set.
+type Source struct {
+	SSHConfig *SSHConfigSource `yaml:"ssh_config"`
+	Terraform *TerraformSource `yaml:"tfstate"`
+}
+
+// load returns the servers of the source and the names of the groups which
+// it generates. Relative paths are resolved from dir.
+func (s *Source) load(dir string) (Inventory, []string, error) {
+	switch {
+	case s.SSHConfig != nil && s.Terraform == nil:
+		servers, err := s.SSHConfig.load(dir)
+		return servers, nil, err
+	case s.Terraform != nil && s.SSHConfig == nil:
+		return s.Terraform.load(dir)
+	default:
+		return nil, nil, fmt.Errorf("inventory source needs to be one of ssh_config or tfstate")
+	}
+}
+
+// ExpandHome replaces a leading `~/` in path with the current user's home
+// directory
+func ExpandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+
+	usr, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %s", err)
+	}
+
+	return filepath.Join(usr.HomeDir, strings.TrimPrefix(path, "~")), nil
+}
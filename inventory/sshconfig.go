@@ -0,0 +1,313 @@
+package inventory
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxSSHConfigDepth limits nested includes and ProxyJump chains
+const maxSSHConfigDepth = 16
+
+// SSHConfigSource imports the hosts of an OpenSSH client config file. Each
+// host alias which doesn't contain wildcards becomes a server and the
+// options of all the matching Host blocks, including wildcard ones, are
+// applied to it. As with ssh, the first value of each option wins.
+type SSHConfigSource struct {
+	// Path defaults to ~/.ssh/config
+	Path string
+	// Groups are added to all the imported servers
+	Groups []string
+}
+
+// sshConfigBlock holds the options of a Host block
+type sshConfigBlock struct {
+	patterns []string
+	options  [][2]string
+}
+
+type sshConfig []*sshConfigBlock
+
+func (src *SSHConfigSource) load(dir string) (Inventory, error) {
+	configPath := src.Path
+	if configPath == "" {
+		configPath = "~/.ssh/config"
+	}
+
+	configPath, err := ExpandHome(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(configPath) {
+		configPath = filepath.Join(dir, configPath)
+	}
+
+	// Options which appear before the first Host block apply to all hosts
+	config := sshConfig{{patterns: []string{"*"}}}
+	err = config.parse(configPath, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ssh config: %s", err)
+	}
+
+	var servers Inventory
+	for _, alias := range config.aliases() {
+		server, err := config.server(alias, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ssh config: %s", err)
+		}
+		server.Groups = src.Groups
+		servers = append(servers, server)
+	}
+
+	return servers, nil
+}
+
+// parse reads the blocks of the config file. Included files are parsed in
+// place, so their options belong to the current block until they start a
+// new one.
+func (c *sshConfig) parse(configPath string, depth int) error {
+	if depth > maxSSHConfigDepth {
+		return fmt.Errorf("too many nested includes in %q", configPath)
+	}
+
+	f, err := os.Open(configPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		keyword, args, err := parseSSHConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", configPath, lineNo, err)
+		}
+		if keyword == "" {
+			continue
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("%s:%d: missing argument for %q", configPath, lineNo, keyword)
+		}
+
+		switch keyword {
+		case "host":
+			*c = append(*c, &sshConfigBlock{patterns: args})
+		case "match":
+			// Match blocks are not supported, so their options are ignored
+			*c = append(*c, &sshConfigBlock{})
+		case "include":
+			for _, pattern := range args {
+				pattern, err := ExpandHome(pattern)
+				if err != nil {
+					return err
+				}
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(filepath.Dir(configPath), pattern)
+				}
+
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return fmt.Errorf("%s:%d: invalid include %q: %s", configPath, lineNo, pattern, err)
+				}
+				for _, match := range matches {
+					err = c.parse(match, depth+1)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		default:
+			block := (*c)[len(*c)-1]
+			block.options = append(block.options, [2]string{keyword, strings.Join(args, " ")})
+		}
+	}
+
+	return scanner.Err()
+}
+
+// parseSSHConfigLine returns the lowercase keyword and the arguments of a
+// config line. Arguments can be quoted and the keyword can be separated from
+// them by `=`.
+func parseSSHConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil, nil
+	}
+
+	end := strings.IndexAny(line, " \t=")
+	if end == -1 {
+		return strings.ToLower(line), nil, nil
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimSpace(line[end:])
+	rest = strings.TrimSpace(strings.TrimPrefix(rest, "="))
+
+	var args []string
+	for rest != "" {
+		if rest[0] == '"' {
+			closing := strings.Index(rest[1:], `"`)
+			if closing == -1 {
+				return "", nil, fmt.Errorf("unterminated quote")
+			}
+			args = append(args, rest[1:closing+1])
+			rest = strings.TrimSpace(rest[closing+2:])
+			continue
+		}
+
+		end := strings.IndexAny(rest, " \t")
+		if end == -1 {
+			end = len(rest)
+		}
+		args = append(args, rest[:end])
+		rest = strings.TrimSpace(rest[end:])
+	}
+
+	return keyword, args, nil
+}
+
+// aliases returns the host aliases which don't contain wildcards, in the
+// order in which they appear
+func (c sshConfig) aliases() []string {
+	var aliases []string
+	seen := make(map[string]bool)
+	for _, block := range c[1:] {
+		for _, pattern := range block.patterns {
+			if strings.ContainsAny(pattern, "*?!") || seen[pattern] {
+				continue
+			}
+			seen[pattern] = true
+			aliases = append(aliases, pattern)
+		}
+	}
+
+	return aliases
+}
+
+// lookup returns the options which apply to the host alias
+func (c sshConfig) lookup(alias string) map[string]string {
+	options := make(map[string]string)
+	for _, block := range c {
+		if !matchSSHPatterns(block.patterns, alias) {
+			continue
+		}
+		for _, option := range block.options {
+			if _, ok := options[option[0]]; !ok {
+				options[option[0]] = option[1]
+			}
+		}
+	}
+
+	return options
+}
+
+// matchSSHPatterns checks if the alias matches any of the patterns and none
+// of the negated ones
+func matchSSHPatterns(patterns []string, alias string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		ok, _ := path.Match(strings.TrimPrefix(pattern, "!"), alias)
+		if ok && negated {
+			return false
+		}
+		matched = matched || ok && !negated
+	}
+
+	return matched
+}
+
+// server builds the server for the host alias, including the jump hosts
+// from ProxyJump, which are looked up in the config as well
+func (c sshConfig) server(alias string, depth int) (*Server, error) {
+	if depth > maxSSHConfigDepth {
+		return nil, fmt.Errorf("too many nested jump hosts for %q", alias)
+	}
+
+	options := c.lookup(alias)
+	server := &Server{Name: alias, Host: alias}
+
+	if hostName := options["hostname"]; hostName != "" {
+		server.Host = strings.Replace(hostName, "%h", alias, -1)
+	}
+
+	if port := options["port"]; port != "" {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q for host %q", port, alias)
+		}
+		server.Port = uint(p)
+	}
+
+	// Servers without a User fall back to the current user, but only after
+	// the group defaults are applied (see defaultToCurrentUser)
+	server.Username = options["user"]
+	server.PrivateKey = options["identityfile"]
+
+	proxyJump := options["proxyjump"]
+	if proxyJump == "" || strings.ToLower(proxyJump) == "none" {
+		return server, nil
+	}
+
+	for _, hop := range strings.Split(proxyJump, ",") {
+		hop = strings.TrimSpace(hop)
+		username := ""
+		if at := strings.LastIndex(hop, "@"); at != -1 {
+			username, hop = hop[:at], hop[at+1:]
+		}
+		port := ""
+		if colon := strings.LastIndex(hop, ":"); colon != -1 {
+			hop, port = hop[:colon], hop[colon+1:]
+		}
+
+		jump, err := c.server(hop, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		if username != "" {
+			jump.Username = username
+		}
+		// Groups don't apply to jump hosts, so they fall back to the current
+		// user right away
+		err = defaultToCurrentUser(Inventory{jump})
+		if err != nil {
+			return nil, err
+		}
+		if port != "" {
+			p, err := strconv.ParseUint(port, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port %q in ProxyJump of host %q", port, alias)
+			}
+			jump.Port = uint(p)
+		}
+
+		// The jump host is reached through its own jump hosts first
+		server.Jump = append(server.Jump, jump.Jump...)
+		jump.Jump = nil
+		server.Jump = append(server.Jump, jump)
+	}
+
+	return server, nil
+}
+
+// defaultToCurrentUser sets the username of the servers which don't have one
+// to the name of the current user, like ssh does
+func defaultToCurrentUser(servers Inventory) error {
+	for _, s := range servers {
+		if s.Username != "" {
+			continue
+		}
+
+		usr, err := user.Current()
+		if err != nil {
+			return fmt.Errorf("failed to get the current user for host %q: %s", s.GetName(), err)
+		}
+		s.Username = usr.Username
+	}
+
+	return nil
+}
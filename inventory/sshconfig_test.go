@@ -0,0 +1,104 @@
+package inventory
+
+import (
+	"os/user"
+	"testing"
+
+	"github.com/mihaitodor/wormhole/vars"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_SSHConfigSource(t *testing.T) {
+	Convey("NewInventory() with an ssh_config source", t, func() {
+		i, err := NewInventory("fixtures/inventory_ssh_config.yaml", nil)
+		So(err, ShouldBeNil)
+
+		servers := make(map[string]*Server)
+		var names []string
+		for _, s := range i {
+			servers[s.GetName()] = s
+			names = append(names, s.GetName())
+		}
+
+		Convey("should import the hosts without wildcards in order", func() {
+			So(names, ShouldResemble, []string{"helms-deep", "bastion", "minas-tirith", "osgiliath", "edoras"})
+		})
+
+		Convey("should apply the options of the matching blocks", func() {
+			bastion := servers["bastion"]
+			So(bastion.GetAddress(), ShouldEqual, "bastion.gondor.example:22")
+			So(bastion.Username, ShouldEqual, "gatekeeper")
+			So(bastion.PrivateKey, ShouldEqual, "~/.ssh/bastion")
+			So(bastion.Jump, ShouldBeEmpty)
+
+			minasTirith := servers["minas-tirith"]
+			So(minasTirith.GetAddress(), ShouldEqual, "minas-tirith.gondor.internal:22")
+			So(minasTirith.PrivateKey, ShouldEqual, "~/.ssh/id_rsa")
+			So(minasTirith.Vars, ShouldResemble, vars.Vars{"managed": true})
+			So(minasTirith.InGroup("engineers"), ShouldBeTrue)
+		})
+
+		Convey("should resolve the jump hosts", func() {
+			minasTirith := servers["minas-tirith"]
+			So(minasTirith.Jump, ShouldHaveLength, 1)
+			So(minasTirith.Jump[0].GetAddress(), ShouldEqual, "bastion.gondor.example:22")
+			So(minasTirith.Jump[0].Username, ShouldEqual, "gatekeeper")
+			So(minasTirith.Username, ShouldEqual, "ranger")
+
+			// Without a User, the current user name is used
+			usr, err := user.Current()
+			So(err, ShouldBeNil)
+
+			edoras := servers["edoras"]
+			So(edoras.GetAddress(), ShouldEqual, "10.0.2.5:2222")
+			So(edoras.Username, ShouldEqual, usr.Username)
+			So(edoras.PrivateKey, ShouldBeEmpty)
+			So(edoras.Jump, ShouldHaveLength, 1)
+			So(edoras.Jump[0].GetAddress(), ShouldEqual, "bastion.gondor.example:2200")
+			So(edoras.Jump[0].Username, ShouldEqual, "horse")
+
+			helmsDeep := servers["helms-deep"]
+			So(helmsDeep.Username, ShouldEqual, "erkenbrand")
+			So(helmsDeep.Jump, ShouldHaveLength, 2)
+			So(helmsDeep.Jump[0].GetAddress(), ShouldEqual, "bastion.gondor.example:2200")
+			So(helmsDeep.Jump[1].GetAddress(), ShouldEqual, "10.0.2.5:2222")
+			So(helmsDeep.Jump[1].Username, ShouldEqual, usr.Username)
+		})
+
+		Convey("should apply the group username to hosts without a User", func() {
+			i, err := NewInventory("fixtures/inventory_ssh_config_groups.yaml", nil)
+			So(err, ShouldBeNil)
+
+			servers := make(map[string]*Server)
+			for _, s := range i {
+				servers[s.GetName()] = s
+			}
+
+			So(servers["edoras"].Username, ShouldEqual, "eomer")
+			So(servers["edoras"].Jump[0].Username, ShouldEqual, "horse")
+			So(servers["minas-tirith"].Username, ShouldEqual, "ranger")
+		})
+	})
+}
+
+func Test_parseSSHConfigLine(t *testing.T) {
+	Convey("parseSSHConfigLine()", t, func() {
+		Convey("should parse keywords and quoted arguments", func() {
+			keyword, args, err := parseSSHConfigLine(`  IdentityFile = "~/.ssh/my key"  other`)
+			So(err, ShouldBeNil)
+			So(keyword, ShouldEqual, "identityfile")
+			So(args, ShouldResemble, []string{"~/.ssh/my key", "other"})
+		})
+
+		Convey("should skip comments", func() {
+			keyword, _, err := parseSSHConfigLine("# Host mordor")
+			So(err, ShouldBeNil)
+			So(keyword, ShouldBeEmpty)
+		})
+
+		Convey("should fail for unterminated quotes", func() {
+			_, _, err := parseSSHConfigLine(`HostName "mordor`)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,204 @@
+package inventory
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TerraformSource imports the instances of a local Terraform state file.
+// The host, user and tags of each instance are read from its attributes and
+// each tag becomes a group named `tag_<key>_<value>`. Instances are also
+// added to a group named after their resource type.
+type TerraformSource struct {
+	// Path defaults to terraform.tfstate
+	Path string
+	// ResourceTypes default to aws_instance
+	ResourceTypes []string `yaml:"resource_types"`
+	// Host is the path of the attribute which holds the host, such as
+	// `network_interface.0.access_config.0.nat_ip`. Defaults to public_ip.
+	// Instances without a host are skipped.
+	Host string
+	// User is the path of the attribute which holds the username, if any
+	User string
+	// Tags is the path of the attribute which holds the tags, either as a
+	// map or a list. Defaults to tags.
+	Tags string
+	// Groups are added to all the imported servers
+	Groups []string
+}
+
+type tfState struct {
+	Version   int
+	Resources []struct {
+		Module    string
+		Mode      string
+		Type      string
+		Name      string
+		Instances []struct {
+			IndexKey   interface{} `json:"index_key"`
+			Attributes map[string]interface{}
+		}
+	}
+}
+
+var invalidGroupChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+func (src *TerraformSource) load(dir string) (Inventory, []string, error) {
+	statePath := src.Path
+	if statePath == "" {
+		statePath = "terraform.tfstate"
+	}
+	if !filepath.IsAbs(statePath) {
+		statePath = filepath.Join(dir, statePath)
+	}
+
+	contents, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open tfstate file: %s", err)
+	}
+
+	var state tfState
+	err = json.Unmarshal(contents, &state)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal tfstate file %q: %s", statePath, err)
+	}
+	if state.Version != 4 {
+		return nil, nil, fmt.Errorf("unsupported tfstate version %d in %q", state.Version, statePath)
+	}
+
+	resourceTypes := src.ResourceTypes
+	if len(resourceTypes) == 0 {
+		resourceTypes = []string{"aws_instance"}
+	}
+	hostAttr := src.Host
+	if hostAttr == "" {
+		hostAttr = "public_ip"
+	}
+	tagsAttr := src.Tags
+	if tagsAttr == "" {
+		tagsAttr = "tags"
+	}
+
+	var servers Inventory
+	groups := make(map[string]bool)
+	for _, resource := range state.Resources {
+		if resource.Mode != "managed" || !containsString(resourceTypes, resource.Type) {
+			continue
+		}
+
+		for _, instance := range resource.Instances {
+			host := attributeString(instance.Attributes, hostAttr)
+			if host == "" {
+				continue
+			}
+
+			name := resource.Name
+			if resource.Module != "" {
+				name = resource.Module + "." + name
+			}
+			if instance.IndexKey != nil {
+				name = fmt.Sprintf("%s.%v", name, instance.IndexKey)
+			}
+
+			server := &Server{
+				Name:     name,
+				Host:     host,
+				Username: attributeString(instance.Attributes, src.User),
+				Groups:   append([]string{resource.Type}, src.Groups...),
+			}
+			server.Groups = append(server.Groups, tagGroups(attribute(instance.Attributes, tagsAttr))...)
+
+			for _, group := range server.Groups {
+				groups[group] = true
+			}
+			servers = append(servers, server)
+		}
+	}
+
+	// Only the generated groups are defined by the source
+	for _, group := range src.Groups {
+		delete(groups, group)
+	}
+	var generated []string
+	for group := range groups {
+		generated = append(generated, group)
+	}
+	sort.Strings(generated)
+
+	return servers, generated, nil
+}
+
+// attribute returns the value at the dotted path in the attributes, where
+// numeric path elements index lists
+func attribute(attributes map[string]interface{}, attrPath string) interface{} {
+	if attrPath == "" {
+		return nil
+	}
+
+	var value interface{} = attributes
+	for _, key := range strings.Split(attrPath, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value = v[key]
+		case []interface{}:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx < 0 || idx >= len(v) {
+				return nil
+			}
+			value = v[idx]
+		default:
+			return nil
+		}
+	}
+
+	return value
+}
+
+func attributeString(attributes map[string]interface{}, attrPath string) string {
+	value := attribute(attributes, attrPath)
+	if value == nil {
+		return ""
+	}
+
+	return fmt.Sprint(value)
+}
+
+// tagGroups returns the group names for the tags, which are either a map or
+// a list of strings
+func tagGroups(tags interface{}) []string {
+	var groups []string
+	switch t := tags.(type) {
+	case map[string]interface{}:
+		for key, value := range t {
+			groups = append(groups, tagGroup(fmt.Sprintf("tag_%s_%v", key, value)))
+		}
+		sort.Strings(groups)
+	case []interface{}:
+		for _, value := range t {
+			groups = append(groups, tagGroup(fmt.Sprintf("tag_%v", value)))
+		}
+	}
+
+	return groups
+}
+
+// tagGroup replaces the characters which can't be used in host patterns
+func tagGroup(name string) string {
+	return invalidGroupChars.ReplaceAllString(name, "_")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
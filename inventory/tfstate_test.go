@@ -0,0 +1,63 @@
+package inventory
+
+import (
+	"testing"
+
+	"github.com/mihaitodor/wormhole/vars"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_TerraformSource(t *testing.T) {
+	Convey("NewInventory() with tfstate sources", t, func() {
+		Convey("should import the instances of the selected resource types", func() {
+			i, err := NewInventory("fixtures/inventory_tfstate.yaml", nil)
+			So(err, ShouldBeNil)
+			So(i, ShouldHaveLength, 2)
+
+			web := i[0]
+			So(web.GetName(), ShouldEqual, "web.0")
+			So(web.GetAddress(), ShouldEqual, "203.0.113.10:22")
+			So(web.Username, ShouldEqual, "ubuntu")
+			So(web.Groups, ShouldResemble, []string{"aws_instance", "terraform", "tag_Env_prod_east", "tag_Role_web"})
+			So(web.Vars, ShouldResemble, vars.Vars{"http_port": 8080})
+
+			db := i[1]
+			So(db.GetName(), ShouldEqual, "module.db.primary")
+			So(db.GetAddress(), ShouldEqual, "198.51.100.7:22")
+			So(db.Username, ShouldEqual, "postgres")
+			So(db.InGroup("tag_db"), ShouldBeTrue)
+			So(db.InGroup("google_compute_instance"), ShouldBeTrue)
+			So(db.InGroup("terraform"), ShouldBeFalse)
+		})
+
+		Convey("should select the imported servers by tag groups", func() {
+			i, err := NewInventory("fixtures/inventory_tfstate.yaml", nil)
+			So(err, ShouldBeNil)
+
+			servers, err := i.Select("tag_Role_web:tag_backup")
+			So(err, ShouldBeNil)
+			So(servers, ShouldHaveLength, 2)
+		})
+	})
+}
+
+func Test_attribute(t *testing.T) {
+	Convey("attribute()", t, func() {
+		attributes := map[string]interface{}{
+			"network_interface": []interface{}{
+				map[string]interface{}{"network_ip": "10.0.0.7"},
+			},
+		}
+
+		Convey("should follow maps and lists", func() {
+			So(attribute(attributes, "network_interface.0.network_ip"), ShouldEqual, "10.0.0.7")
+		})
+
+		Convey("should return nil for missing attributes", func() {
+			So(attribute(attributes, "network_interface.1.network_ip"), ShouldBeNil)
+			So(attribute(attributes, "network_interface.x"), ShouldBeNil)
+			So(attribute(attributes, "public_ip"), ShouldBeNil)
+			So(attribute(attributes, ""), ShouldBeNil)
+		})
+	})
+}
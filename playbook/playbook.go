@@ -5,62 +5,159 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"sync"
 
 	"github.com/mihaitodor/wormhole/actions"
 	"github.com/mihaitodor/wormhole/config"
 	"github.com/mihaitodor/wormhole/transport"
+	"github.com/mihaitodor/wormhole/vars"
+	"github.com/mihaitodor/wormhole/vault"
+	"github.com/mitchellh/mapstructure"
 	log "github.com/sirupsen/logrus"
 	yaml "gopkg.in/yaml.v2"
 )
 
 type Task struct {
-	Name    string
+	Name string
+	actions.BecomeSettings
 	Actions []actions.Action
 }
 
 type Playbook struct {
-	Tasks []Task
+	// Hosts is the pattern which selects the servers from the inventory on
+	// which the playbook runs. All the servers are selected by default.
+	Hosts string
+	// Serial splits the servers into batches, which run one after the other
+	Serial Serial
+	// MaxFailPercentage aborts the remaining batches when the percentage of
+	// servers which failed in a batch exceeds it
+	MaxFailPercentage *float64 `yaml:"max_fail_percentage"`
+	// Strategy is either StrategyFree or StrategyLinear
+	Strategy               string
+	actions.BecomeSettings `yaml:",inline"`
+	Vars                   vars.Vars
+	Tasks                  []Task
 }
 
-func (p *Playbook) Run(ctx context.Context, wg *sync.WaitGroup, conn transport.Connection, conf config.Config) {
-	defer wg.Done()
+// Strategies control how the tasks of the playbook are run on the servers
+const (
+	// StrategyFree runs the whole playbook on each server independently
+	// (default)
+	StrategyFree = "free"
+	// StrategyLinear runs each task on all the servers of a batch before
+	// the next task starts on any of them
+	StrategyLinear = "linear"
+)
 
-	for idx, task := range p.Tasks {
-		log.Infof(
-			"Running task [%d/%d] on %q: %s", idx+1,
-			len(p.Tasks), conn.GetAddress(), task.Name,
-		)
+// Run runs the playbook on the server behind conn. The playbook variables
+// are merged with the host variables and the extra variables from conf, in
+// increasing order of precedence. The string fields of each action are
+// interpolated with the variables before it runs. The outcome of each action
+// is counted in stats.
+func (p *Playbook) Run(ctx context.Context, conn transport.Connection, conf config.Config, hostVars vars.Vars, stats *Stats) {
+	scope := p.NewScope(conn, conf, hostVars)
 
-		for _, a := range task.Actions {
-			// Make sure we cancel the action if ExecTimeout is exceeded
-			ctx, cancel := context.WithTimeout(ctx, conf.ExecTimeout)
-			err := a.Run(ctx, conn, conf)
-			cancel()
-			if err != nil {
-				// Something went wrong and the playbook needs to be
-				// rerun on this host.
+	for idx := range p.Tasks {
+		err := p.RunTask(ctx, conn, conf, scope, idx, stats)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// NewScope returns the variables available to the playbook on the server
+// behind conn. The same scope needs to be passed to all the tasks which run
+// on that server, so facts are only gathered once.
+func (p *Playbook) NewScope(conn transport.Connection, conf config.Config, hostVars vars.Vars) *vars.Scope {
+	return vars.NewScope(vars.Merge(p.Vars, hostVars, conf.ExtraVars), func(ctx context.Context) (vars.Vars, error) {
+		return actions.GatherFacts(ctx, conn)
+	})
+}
+
+// RunTask runs the task with the given index on the server behind conn. If
+// any of its actions fails, the error is also set on conn and the rest of
+// the actions are skipped. The outcome of each action is counted in stats.
+func (p *Playbook) RunTask(ctx context.Context, conn transport.Connection, conf config.Config, scope *vars.Scope, idx int, stats *Stats) error {
+	task := p.Tasks[idx]
+	log.Infof(
+		"Running task [%d/%d] on %q: %s", idx+1,
+		len(p.Tasks), conn.GetAddress(), task.Name,
+	)
+
+	for _, a := range task.Actions {
+		// Make sure we cancel the action if ExecTimeout is exceeded
+		ctx, cancel := context.WithTimeout(ctx, conf.ExecTimeout)
+
+		var result actions.Result
+		action, err := actions.Interpolate(a, scope)
+		if err == nil {
+			actionConn := conn
+			if become := action.GetBecome(); become.Enabled() {
+				actionConn = transport.WithBecome(conn, become.BecomeMethod, become.BecomeUser)
+			}
+
+			result, err = runAction(ctx, action, actionConn, conf, scope)
+		}
+		ctxErr := ctx.Err()
+		cancel()
+		if err != nil {
+			// Something went wrong and the playbook needs to be
+			// rerun on this host.
+			if ctxErr != nil {
+				log.Warnf(
+					"Cancelled action %q on %q: %s",
+					a.GetType(), conn.GetAddress(), ctxErr,
+				)
+			} else {
 				log.Warnf(
 					"Failed to run action %q on %q: %s",
 					a.GetType(), conn.GetAddress(), err,
 				)
+			}
 
-				conn.SetError(err)
+			conn.SetError(err)
+			stats.Failed++
 
-				return
-			}
+			return err
 		}
+
+		log.Infof("Action %q on %q: %s", a.GetType(), conn.GetAddress(), result.Status)
+		stats.Add(result)
 	}
+
+	return nil
+}
+
+// runAction runs the action or, in check mode, only checks it if it
+// supports that
+func runAction(ctx context.Context, action actions.Action, conn transport.Connection, conf config.Config, scope *vars.Scope) (actions.Result, error) {
+	if !conf.Check {
+		return action.Run(ctx, conn, conf, scope)
+	}
+
+	checker, ok := action.(actions.Checker)
+	if !ok {
+		return actions.Result{Status: actions.StatusSkipped}, nil
+	}
+
+	return checker.Check(ctx, conn, conf, scope)
 }
 
-func NewPlaybook(playbookFile string) (*Playbook, error) {
+// NewPlaybook loads the playbook from playbookFile. Contents encrypted with
+// the vault are decrypted with v, which can be nil if no vault password was
+// supplied.
+func NewPlaybook(playbookFile string, v *vault.Vault) (*Playbook, error) {
 	fileContents, err := ioutil.ReadFile(playbookFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open playbook file: %s", err)
 	}
 
+	fileContents, err = v.DecryptYAML(fileContents)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt playbook contents: %s", err)
+	}
+
 	var playbook Playbook
-	err = yaml.Unmarshal(fileContents, &playbook.Tasks)
+	err = yaml.Unmarshal(fileContents, &playbook)
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal playbook contents: %s", err)
 	}
@@ -68,17 +165,89 @@ func NewPlaybook(playbookFile string) (*Playbook, error) {
 	return &playbook, nil
 }
 
+// UnmarshalYAML unmarshals either a plain sequence of tasks or a mapping
+// with the playbook settings and the tasks. The become settings are passed
+// down to each task and action.
+func (p *Playbook) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var rawPlaybook interface{}
+	err := unmarshal(&rawPlaybook)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := rawPlaybook.([]interface{}); ok {
+		err = unmarshal(&p.Tasks)
+	} else {
+		// Avoid infinite recursion
+		type playbook Playbook
+		err = unmarshal((*playbook)(p))
+	}
+	if err != nil {
+		return err
+	}
+
+	err = p.BecomeSettings.Validate()
+	if err != nil {
+		return err
+	}
+
+	switch p.Strategy {
+	case "":
+		p.Strategy = StrategyFree
+	case StrategyFree, StrategyLinear:
+	default:
+		return fmt.Errorf("unrecognised strategy: %q", p.Strategy)
+	}
+
+	if p.MaxFailPercentage != nil && (*p.MaxFailPercentage < 0 || *p.MaxFailPercentage > 100) {
+		return fmt.Errorf("max_fail_percentage needs to be between 0 and 100")
+	}
+
+	for i := range p.Tasks {
+		task := &p.Tasks[i]
+		task.BecomeSettings = task.BecomeSettings.Inherit(p.BecomeSettings)
+		for _, a := range task.Actions {
+			a.InheritBecome(task.BecomeSettings)
+		}
+	}
+
+	return nil
+}
+
 // UnmarshalYAML unmarshals a task and populates known actions into their
-// specific objects.
+// specific objects. The actions are kept in the order in which they appear,
+// either as keys of the task or as items of its `actions` list.
 func (t *Task) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	var rawTask map[string]interface{}
+	// Use a MapSlice to preserve the order of the actions
+	var rawTask yaml.MapSlice
 	err := unmarshal(&rawTask)
 	if err != nil {
 		return fmt.Errorf("failed to unmarshal task: %s", err)
 	}
 
-	rawName, ok := rawTask["name"]
-	if !ok {
+	var rawName, rawActionList interface{}
+	var hasName bool
+	var rawActions yaml.MapSlice
+	rawBecome := make(map[string]interface{})
+	for _, item := range rawTask {
+		key, ok := item.Key.(string)
+		if !ok {
+			return fmt.Errorf("task keys need to be strings, got: %v", item.Key)
+		}
+
+		switch key {
+		case "name":
+			rawName, hasName = item.Value, true
+		case "actions":
+			rawActionList = item.Value
+		case "become", "become_method", "become_user":
+			rawBecome[key] = item.Value
+		default:
+			rawActions = append(rawActions, item)
+		}
+	}
+
+	if !hasName {
 		return errors.New("missing 'name' field")
 	}
 
@@ -89,11 +258,44 @@ func (t *Task) UnmarshalYAML(unmarshal func(interface{}) error) error {
 
 	t.Name = taskName
 
-	// Delete name field, since it doesn't represent an action
-	delete(rawTask, "name")
+	err = mapstructure.Decode(rawBecome, &t.BecomeSettings)
+	if err != nil {
+		return fmt.Errorf("failed to decode become settings of task %q: %s", t.Name, err)
+	}
+
+	err = t.BecomeSettings.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid become settings for task %q: %s", t.Name, err)
+	}
+
+	if rawActionList != nil {
+		if len(rawActions) > 0 {
+			return fmt.Errorf("task %q can't have both an 'actions' list and other actions", t.Name)
+		}
+
+		list, ok := rawActionList.([]interface{})
+		if !ok {
+			return fmt.Errorf("'actions' field of task %q needs to be a list", t.Name)
+		}
+
+		for idx, rawItem := range list {
+			// Each list item needs to be a `type: action` mapping
+			item, ok := rawItem.(yaml.MapSlice)
+			if !ok || len(item) != 1 {
+				return fmt.Errorf("item %d of the 'actions' list of task %q needs to contain a single action", idx+1, t.Name)
+			}
+
+			rawActions = append(rawActions, item[0])
+		}
+	}
+
+	for _, item := range rawActions {
+		actionType, ok := item.Key.(string)
+		if !ok {
+			return fmt.Errorf("action types need to be strings, got: %v", item.Key)
+		}
 
-	for actionType, action := range rawTask {
-		action, err := actions.UnmarshalAction(actionType, action)
+		action, err := actions.UnmarshalAction(actionType, plainValue(item.Value))
 		if err != nil {
 			return fmt.Errorf("failed to unmarshal action %q from task %q: %s", actionType, t.Name, err)
 		}
@@ -107,3 +309,24 @@ func (t *Task) UnmarshalYAML(unmarshal func(interface{}) error) error {
 
 	return nil
 }
+
+// plainValue converts the nested MapSlice values produced when unmarshalling
+// into a MapSlice back to regular maps, which mapstructure can decode
+func plainValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		m := make(map[interface{}]interface{}, len(v))
+		for _, item := range v {
+			m[item.Key] = plainValue(item.Value)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = plainValue(item)
+		}
+		return list
+	default:
+		return value
+	}
+}
@@ -2,19 +2,22 @@ package playbook
 
 import (
 	"context"
-	"sync"
+	"io"
 	"testing"
 	"time"
 
+	"github.com/mihaitodor/wormhole/actions"
 	"github.com/mihaitodor/wormhole/config"
 	"github.com/mihaitodor/wormhole/transport"
+	"github.com/mihaitodor/wormhole/vars"
+	"github.com/mihaitodor/wormhole/vault"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
 func Test_NewPlaybook(t *testing.T) {
 	Convey("NewPlaybook()", t, func() {
 		Convey("should load a playbook", func() {
-			p, err := NewPlaybook("fixtures/playbook.yaml")
+			p, err := NewPlaybook("fixtures/playbook.yaml", nil)
 
 			So(err, ShouldBeNil)
 			So(p.Tasks, ShouldHaveLength, 2)
@@ -23,26 +26,126 @@ func Test_NewPlaybook(t *testing.T) {
 			So(p.Tasks[1].Actions, ShouldHaveLength, 2)
 		})
 
+		Convey("should load a playbook with become settings", func() {
+			p, err := NewPlaybook("fixtures/playbook_become.yaml", nil)
+			So(err, ShouldBeNil)
+			So(p.Tasks, ShouldHaveLength, 3)
+
+			become := p.Tasks[0].Actions[0].GetBecome()
+			So(become.Enabled(), ShouldBeTrue)
+			So(become.BecomeMethod, ShouldBeEmpty)
+			So(become.BecomeUser, ShouldEqual, "admin")
+
+			become = p.Tasks[1].Actions[0].GetBecome()
+			So(become.Enabled(), ShouldBeTrue)
+			So(become.BecomeMethod, ShouldEqual, "su")
+			So(become.BecomeUser, ShouldEqual, "www-data")
+
+			So(p.Tasks[2].Actions[0].GetBecome().Enabled(), ShouldBeFalse)
+		})
+
+		Convey("should reject tasks with invalid become methods", func() {
+			_, err := NewPlaybook("fixtures/playbook_task_invalid_become.yaml", nil)
+
+			So(err.Error(), ShouldContainSubstring, "unrecognised become method: \"doas\"")
+		})
+
+		Convey("should load the playbook variables", func() {
+			p, err := NewPlaybook("fixtures/playbook_vars.yaml", nil)
+			So(err, ShouldBeNil)
+			So(p.Hosts, ShouldEqual, "webservers:!staging")
+			So(p.Vars, ShouldResemble, vars.Vars{
+				"server_name": "example.com",
+				"modules":     []interface{}{"rewrite", "headers"},
+			})
+			So(p.Tasks[0].Actions[0], ShouldHaveSameTypeAs, &actions.TemplateAction{})
+		})
+
+		Convey("should load the strategy", func() {
+			p, err := NewPlaybook("fixtures/playbook_serial.yaml", nil)
+			So(err, ShouldBeNil)
+			So(p.Strategy, ShouldEqual, StrategyLinear)
+
+			p, err = NewPlaybook("fixtures/playbook_vars.yaml", nil)
+			So(err, ShouldBeNil)
+			So(p.Strategy, ShouldEqual, StrategyFree)
+
+			_, err = NewPlaybook("fixtures/playbook_invalid_strategy.yaml", nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "unrecognised strategy: \"lockstep\"")
+		})
+
+		Convey("should load the serial settings", func() {
+			p, err := NewPlaybook("fixtures/playbook_serial.yaml", nil)
+			So(err, ShouldBeNil)
+			So(p.Serial, ShouldResemble, Serial{"1", "10%", "50%"})
+			So(*p.MaxFailPercentage, ShouldEqual, 25)
+
+			_, err = NewPlaybook("fixtures/playbook_invalid_serial.yaml", nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "invalid serial percentage \"150%\"")
+		})
+
+		Convey("should decrypt vault encrypted playbooks", func() {
+			p, err := NewPlaybook("fixtures/playbook_vault.yaml", vault.New("speak friend"))
+			So(err, ShouldBeNil)
+			So(p.Hosts, ShouldEqual, "gondor")
+			So(p.Tasks, ShouldHaveLength, 1)
+			So(p.Tasks[0].Name, ShouldEqual, "Light the beacons")
+
+			_, err = NewPlaybook("fixtures/playbook_vault.yaml", nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "failed to decrypt playbook contents")
+		})
+
+		Convey("should keep the actions in order", func() {
+			p, err := NewPlaybook("fixtures/playbook_ordered_actions.yaml", nil)
+			So(err, ShouldBeNil)
+			So(p.Tasks, ShouldHaveLength, 2)
+
+			var types []string
+			for _, a := range p.Tasks[0].Actions {
+				types = append(types, a.GetType())
+			}
+			So(types, ShouldResemble, []string{"file", "shell", "service"})
+
+			Convey("and allow repeated actions in an actions list", func() {
+				taskActions := p.Tasks[1].Actions
+				So(taskActions, ShouldHaveLength, 3)
+				So(taskActions[0].(*actions.ShellAction).Command, ShouldEqual, "echo one")
+				So(taskActions[1].(*actions.FileAction).Dest, ShouldEqual, "/etc/test.conf")
+				So(taskActions[1].GetBecome().Enabled(), ShouldBeFalse)
+				So(taskActions[2].(*actions.ShellAction).Command, ShouldEqual, "echo two")
+				So(taskActions[2].GetBecome().Enabled(), ShouldBeTrue)
+			})
+		})
+
+		Convey("should reject tasks with both inline actions and an actions list", func() {
+			_, err := NewPlaybook("fixtures/playbook_task_mixed_actions.yaml", nil)
+
+			So(err.Error(), ShouldContainSubstring, "can't have both an 'actions' list and other actions")
+		})
+
 		Convey("should reject playbooks with empty tasks", func() {
-			_, err := NewPlaybook("fixtures/playbook_task_no_actions.yaml")
+			_, err := NewPlaybook("fixtures/playbook_task_no_actions.yaml", nil)
 
 			So(err.Error(), ShouldContainSubstring, "has no actions")
 		})
 
 		Convey("should reject playbooks with nameless tasks", func() {
-			_, err := NewPlaybook("fixtures/playbook_task_no_name.yaml")
+			_, err := NewPlaybook("fixtures/playbook_task_no_name.yaml", nil)
 
 			So(err.Error(), ShouldContainSubstring, "'name' field needs to be a non-empty string")
 		})
 
 		Convey("should reject playbooks with unrecognised actions", func() {
-			_, err := NewPlaybook("fixtures/playbook_task_unrecognised_action.yaml")
+			_, err := NewPlaybook("fixtures/playbook_task_unrecognised_action.yaml", nil)
 
 			So(err.Error(), ShouldContainSubstring, "unrecognised action")
 		})
 
 		Convey("should reject playbooks with invalid actions", func() {
-			_, err := NewPlaybook("fixtures/playbook_task_invalid_action.yaml")
+			_, err := NewPlaybook("fixtures/playbook_task_invalid_action.yaml", nil)
 
 			So(err, ShouldNotBeNil)
 			So(err.Error(), ShouldContainSubstring, "failed to decode action")
@@ -52,11 +155,17 @@ func Test_NewPlaybook(t *testing.T) {
 
 type dummyConnection struct {
 	execInvocationCount uint
+	copiedFiles         []string
 }
 
 func (*dummyConnection) Close() error { return nil }
-func (c *dummyConnection) Exec(context.Context, bool, transport.ExecCallbackFunc) error {
+func (c *dummyConnection) Exec(context.Context, bool, transport.ExecCallbackFunc) (*transport.Result, error) {
+	c.execInvocationCount++
+	return &transport.Result{}, nil
+}
+func (c *dummyConnection) CopyFile(_ context.Context, _ io.Reader, _ int64, dest, _ string) error {
 	c.execInvocationCount++
+	c.copiedFiles = append(c.copiedFiles, dest)
 	return nil
 }
 func (*dummyConnection) GetAddress() string { return "" }
@@ -65,23 +174,47 @@ func (*dummyConnection) SetError(err error) {}
 
 func Test_Run(t *testing.T) {
 	Convey("Playbook.Run()", t, func() {
-		playbookActionCount := 4
-		p, err := NewPlaybook("fixtures/playbook.yaml")
+		// Including the state queries of the apt and file actions
+		playbookActionCount := 6
+		p, err := NewPlaybook("fixtures/playbook.yaml", nil)
 		So(err, ShouldBeNil)
 
 		conf := config.Config{
-			ExecTimeout: 100 * time.Millisecond,
+			PlaybookFolder: "fixtures",
+			ExecTimeout:    100 * time.Millisecond,
 		}
 
 		conn := dummyConnection{}
-		var wg sync.WaitGroup
+		var stats Stats
 
 		Convey("should run the provided playbook", func() {
-			wg.Add(1)
-			p.Run(context.Background(), &wg, &conn, conf)
-			wg.Wait()
+			p.Run(context.Background(), &conn, conf, nil, &stats)
 
 			So(conn.execInvocationCount, ShouldEqual, playbookActionCount)
+			So(stats, ShouldResemble, Stats{Changed: 3})
+		})
+
+		Convey("should only check the actions in check mode", func() {
+			conf.Check = true
+			p.Run(context.Background(), &conn, conf, nil, &stats)
+
+			// Only the state queries of the apt and file actions run
+			So(conn.execInvocationCount, ShouldEqual, 2)
+			So(conn.copiedFiles, ShouldBeEmpty)
+			So(stats, ShouldResemble, Stats{Changed: 2, Skipped: 1})
+		})
+
+		Convey("should interpolate variables in order of precedence", func() {
+			p, err := NewPlaybook("fixtures/playbook_interpolation.yaml", nil)
+			So(err, ShouldBeNil)
+
+			conf.ExtraVars = vars.Vars{"steward": "aragorn"}
+			hostVars := vars.Vars{"realm": "arnor", "steward": "boromir"}
+
+			p.Run(context.Background(), &conn, conf, hostVars, &stats)
+
+			So(conn.copiedFiles, ShouldResemble, []string{"/etc/arnor/aragorn.conf"})
+			So(p.Tasks[0].Actions[0].(*actions.FileAction).Dest, ShouldContainSubstring, "{{realm}}")
 		})
 	})
 }
@@ -0,0 +1,86 @@
+package playbook
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Serial holds the sizes of the batches of servers on which the playbook
+// runs one after the other. Each size is either a count or a percentage of
+// all the servers, such as "30%". The last size is repeated until all the
+// servers are covered.
+type Serial []string
+
+// UnmarshalYAML accepts either a single size or a list of sizes
+func (s *Serial) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var sizes []string
+	err := unmarshal(&sizes)
+	if err != nil {
+		var size string
+		err = unmarshal(&size)
+		if err != nil {
+			return fmt.Errorf("serial needs to be a count, a percentage or a list of them")
+		}
+		sizes = []string{size}
+	}
+
+	for _, size := range sizes {
+		_, err := batchSize(size, 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	*s = sizes
+	return nil
+}
+
+// Batches returns the number of servers in each batch
+func (s Serial) Batches(servers int) []int {
+	if len(s) == 0 {
+		return []int{servers}
+	}
+
+	var batches []int
+	for i, remaining := 0, servers; remaining > 0; i++ {
+		size := s[len(s)-1]
+		if i < len(s) {
+			size = s[i]
+		}
+
+		// Sizes are validated when the playbook is loaded
+		n, _ := batchSize(size, servers)
+		if n > remaining {
+			n = remaining
+		}
+		batches = append(batches, n)
+		remaining -= n
+	}
+
+	return batches
+}
+
+// batchSize converts a count or a percentage of total to a count. Non-zero
+// percentages are at least 1.
+func batchSize(size string, total int) (int, error) {
+	if strings.HasSuffix(size, "%") {
+		percentage, err := strconv.ParseFloat(strings.TrimSuffix(size, "%"), 64)
+		if err != nil || percentage <= 0 || percentage > 100 {
+			return 0, fmt.Errorf("invalid serial percentage %q", size)
+		}
+
+		n := int(float64(total) * percentage / 100)
+		if n < 1 {
+			n = 1
+		}
+		return n, nil
+	}
+
+	n, err := strconv.Atoi(size)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid serial count %q", size)
+	}
+
+	return n, nil
+}
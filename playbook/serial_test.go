@@ -0,0 +1,41 @@
+package playbook
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func Test_Serial(t *testing.T) {
+	Convey("Serial", t, func() {
+		Convey("should accept a single size", func() {
+			var s Serial
+			So(yaml.Unmarshal([]byte("3"), &s), ShouldBeNil)
+			So(s, ShouldResemble, Serial{"3"})
+
+			So(yaml.Unmarshal([]byte("30%"), &s), ShouldBeNil)
+			So(s, ShouldResemble, Serial{"30%"})
+		})
+
+		Convey("should reject invalid sizes", func() {
+			for _, input := range []string{"0", "-2", "0%", "101%", "many", "[1, {}]"} {
+				var s Serial
+				So(yaml.Unmarshal([]byte(input), &s), ShouldNotBeNil)
+			}
+		})
+
+		Convey("should run everything in one batch by default", func() {
+			So(Serial(nil).Batches(7), ShouldResemble, []int{7})
+		})
+
+		Convey("should repeat the last size", func() {
+			So(Serial{"2"}.Batches(7), ShouldResemble, []int{2, 2, 2, 1})
+			So(Serial{"1", "10%", "50%"}.Batches(20), ShouldResemble, []int{1, 2, 10, 7})
+		})
+
+		Convey("should run at least one server per batch", func() {
+			So(Serial{"10%"}.Batches(3), ShouldResemble, []int{1, 1, 1})
+		})
+	})
+}
@@ -0,0 +1,31 @@
+package playbook
+
+import (
+	"fmt"
+
+	"github.com/mihaitodor/wormhole/actions"
+)
+
+// Stats counts the outcomes of the actions which ran on a server
+type Stats struct {
+	OK      int
+	Changed int
+	Skipped int
+	Failed  int
+}
+
+// Add counts an action which ran successfully
+func (s *Stats) Add(result actions.Result) {
+	switch result.Status {
+	case actions.StatusChanged:
+		s.Changed++
+	case actions.StatusSkipped:
+		s.Skipped++
+	default:
+		s.OK++
+	}
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("ok=%d changed=%d skipped=%d failed=%d", s.OK, s.Changed, s.Skipped, s.Failed)
+}
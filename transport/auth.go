@@ -0,0 +1,102 @@
+package transport
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/mihaitodor/wormhole/inventory"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// loadPrivateKey reads and parses a private key file, decrypting it with the
+// given passphrase if needed
+func loadPrivateKey(path, passphrase string) (ssh.Signer, error) {
+	path, err := inventory.ExpandHome(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %s", err)
+	}
+
+	var signer ssh.Signer
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(pemBytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %q: %s", path, err)
+	}
+
+	return signer, nil
+}
+
+// authMethods builds the list of ssh authentication methods for a server.
+// They are attempted in the following order:
+//  1. The private key file, if the server has one configured
+//  2. The keys offered by ssh-agent, if SSH_AUTH_SOCK is set
+//  3. The password, if the server has one configured
+//
+// The returned ssh-agent connection, if not nil, needs to be closed after the
+// handshake completes.
+func authMethods(server *inventory.Server) ([]ssh.AuthMethod, net.Conn, error) {
+	var signers []ssh.Signer
+	if server.PrivateKey != "" {
+		signer, err := loadPrivateKey(server.PrivateKey, server.Passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+		signers = append(signers, signer)
+	}
+
+	var agentConn net.Conn
+	var agentClient agent.Agent
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		var err error
+		agentConn, err = net.Dial("unix", socket)
+		if err != nil {
+			// Don't fail hard, since there may be other auth methods left
+			log.Warnf("Failed to connect to ssh-agent: %s", err)
+		} else {
+			agentClient = agent.NewClient(agentConn)
+		}
+	}
+
+	var methods []ssh.AuthMethod
+
+	// NB: The ssh client only attempts each auth method type once, so the
+	// private key and the ssh-agent keys need to be tried as a single method.
+	if len(signers) > 0 || agentClient != nil {
+		methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			if agentClient == nil {
+				return signers, nil
+			}
+
+			agentSigners, err := agentClient.Signers()
+			if err != nil {
+				log.Warnf("Failed to get keys from ssh-agent: %s", err)
+				return signers, nil
+			}
+
+			return append(signers, agentSigners...), nil
+		}))
+	}
+
+	if server.Password != "" {
+		methods = append(methods, ssh.Password(server.Password))
+	}
+
+	if len(methods) == 0 {
+		// Fall back to an empty password, which some servers accept
+		methods = append(methods, ssh.Password(""))
+	}
+
+	return methods, agentConn, nil
+}
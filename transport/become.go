@@ -0,0 +1,202 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Privilege escalation methods
+const (
+	BecomeSudo = "sudo"
+	BecomeSu   = "su"
+)
+
+// sudoPrompt is the custom password prompt passed to sudo, so we can tell it
+// apart from the output of the command
+const sudoPrompt = "[wormhole] become password:"
+
+// suPrompt is the password prompt printed by su in the C locale
+const suPrompt = "Password: "
+
+// Become describes how commands are executed as a different user
+type Become struct {
+	// Method is either sudo (default) or su
+	Method string
+	// User is the target user, root by default
+	User     string
+	Password string
+}
+
+// ValidateBecomeMethod checks if the given privilege escalation method is
+// supported. An empty method selects sudo.
+func ValidateBecomeMethod(method string) error {
+	switch method {
+	case "", BecomeSudo, BecomeSu:
+		return nil
+	default:
+		return fmt.Errorf("unrecognised become method: %q", method)
+	}
+}
+
+func (b *Become) user() string {
+	if b.User == "" {
+		return "root"
+	}
+
+	return b.User
+}
+
+// wrap returns the command which runs the given command as the target user
+// and the responder for its password prompt
+func (b *Become) wrap(sess *Session, command string) (string, *becomeResponder) {
+	r := &becomeResponder{sess: sess, password: b.Password}
+
+	if b.Method == BecomeSu {
+		// su reads the password from the terminal, so it needs a pty
+		r.prompt = []byte(suPrompt)
+		return fmt.Sprintf("LC_ALL=C su %s -c %s", shellQuote(b.user()), shellQuote(command)), r
+	}
+
+	r.prompt = []byte(sudoPrompt)
+	r.reprompts = true
+	return fmt.Sprintf(
+		"sudo -S -p %s -u %s -- /bin/sh -c %s",
+		shellQuote(sudoPrompt), shellQuote(b.user()), shellQuote(command),
+	), r
+}
+
+// shellQuote quotes s for the POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// becomeResponder answers the password prompt of sudo or su on stdin and
+// strips it from the output of the process
+type becomeResponder struct {
+	mu       sync.Mutex
+	sess     *Session
+	prompt   []byte
+	password string
+	// reprompts is set if the prompt shows up again after a wrong password
+	reprompts bool
+	answered  bool
+	err       error
+}
+
+// filter forwards everything written to it to dest, except for password
+// prompts. Bytes which may be the beginning of a prompt are held back in
+// pending until the next write.
+func (r *becomeResponder) filter(dest io.Writer, pending *[]byte, p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	buf := append(*pending, p...)
+	for len(r.prompt) > 0 {
+		idx := bytes.Index(buf, r.prompt)
+		if idx < 0 {
+			break
+		}
+
+		dest.Write(buf[:idx])
+		buf = buf[idx+len(r.prompt):]
+		r.respond()
+	}
+
+	// Hold back the longest suffix which is a prefix of the prompt
+	held := 0
+	if len(r.prompt) > 0 {
+		held = len(r.prompt) - 1
+	}
+	if held > len(buf) {
+		held = len(buf)
+	}
+	for ; held > 0; held-- {
+		if bytes.HasPrefix(r.prompt, buf[len(buf)-held:]) {
+			break
+		}
+	}
+
+	dest.Write(buf[:len(buf)-held])
+	*pending = append([]byte(nil), buf[len(buf)-held:]...)
+}
+
+// respond writes the password to stdin the first time the prompt shows up.
+// If it shows up again, the password was rejected, so the process gets
+// interrupted.
+func (r *becomeResponder) respond() {
+	if r.err != nil {
+		return
+	}
+
+	switch {
+	case r.password == "":
+		r.err = errors.New("missing become password")
+	case r.answered:
+		r.err = errors.New("incorrect become password")
+	default:
+		r.answered = true
+		if !r.reprompts {
+			// Stop looking for the prompt in the output of the command
+			r.prompt = nil
+		}
+		_, err := io.WriteString(r.sess.stdin, r.password+"\n")
+		if err != nil {
+			r.err = fmt.Errorf("failed to send become password: %s", err)
+		}
+		return
+	}
+
+	// Write errors can be ignored, since the process may be gone already
+	if r.sess.interrupt != nil {
+		r.sess.interrupt()
+	}
+	r.sess.CloseStdin()
+}
+
+// becomePassworder is implemented by connections which can provide the
+// become password configured in the inventory
+type becomePassworder interface {
+	becomePassword() string
+}
+
+// becomeConnection runs all commands as a different user
+type becomeConnection struct {
+	Connection
+	become Become
+}
+
+// WithBecome returns a connection which executes commands as the user
+// selected by method and user. The password is taken from the inventory.
+// Files are still copied as the user who logged in.
+func WithBecome(conn Connection, method, user string) Connection {
+	become := Become{Method: method, User: user}
+	if p, ok := conn.(becomePassworder); ok {
+		become.Password = p.becomePassword()
+	}
+
+	return &becomeConnection{Connection: conn, become: become}
+}
+
+// WithoutBecome returns the connection wrapped by WithBecome, which executes
+// commands as the user who logged in. Other connections are returned as is.
+func WithoutBecome(conn Connection) Connection {
+	if b, ok := conn.(*becomeConnection); ok {
+		return b.Connection
+	}
+
+	return conn
+}
+
+func (conn *becomeConnection) Exec(ctx context.Context, withTerminal bool, fn ExecCallbackFunc) (*Result, error) {
+	return conn.Connection.Exec(ctx, withTerminal, func(sess *Session) (error, *errgroup.Group) {
+		sess.setBecome(&conn.become)
+		return fn(sess)
+	})
+}
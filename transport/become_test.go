@@ -0,0 +1,113 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mihaitodor/wormhole/config"
+	"github.com/mihaitodor/wormhole/transport/sshtest"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/sync/errgroup"
+)
+
+func Test_becomeResponder(t *testing.T) {
+	Convey("becomeResponder.filter()", t, func() {
+		var stdin, output bytes.Buffer
+		sess := &Session{stdin: nopWriteCloser{&stdin}}
+		r := &becomeResponder{sess: sess, prompt: []byte(sudoPrompt), password: "mellon", reprompts: true}
+		var pending []byte
+
+		Convey("should answer prompts split across writes", func() {
+			r.filter(&output, &pending, []byte("hello "+sudoPrompt[:5]))
+			So(output.String(), ShouldEqual, "hello ")
+			So(stdin.String(), ShouldBeEmpty)
+
+			r.filter(&output, &pending, []byte(sudoPrompt[5:]+"world"))
+			So(output.String(), ShouldEqual, "hello world")
+			So(stdin.String(), ShouldEqual, "mellon\n")
+			So(pending, ShouldBeEmpty)
+		})
+
+		Convey("should fail when the prompt shows up again", func() {
+			r.filter(&output, &pending, []byte(sudoPrompt+"Sorry, try again.\n"+sudoPrompt))
+			So(output.String(), ShouldEqual, "Sorry, try again.\n")
+			So(r.err.Error(), ShouldEqual, "incorrect become password")
+		})
+	})
+}
+
+type nopWriteCloser struct {
+	*bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func Test_WithBecome(t *testing.T) {
+	Convey("WithBecome()", t, func() {
+		server, err := sshtest.NewServer("gandalf", "mellon")
+		So(err, ShouldBeNil)
+		server.BecomePassword = "friend"
+
+		inv := server.Inventory()
+		inv.BecomePassword = "friend"
+		conn, err := NewConnection(inv, config.Config{
+			ConnectTimeout:  500 * time.Millisecond,
+			HostKeyChecking: config.HostKeyCheckingOff,
+		})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			So(conn.Close(), ShouldBeNil)
+			So(server.Close(), ShouldBeNil)
+		})
+
+		exec := func(conn Connection, withTerminal bool) (*Result, error) {
+			return conn.Exec(context.Background(), withTerminal, func(sess *Session) (error, *errgroup.Group) {
+				return sess.Start(`echo "I am $SSHTEST_BECOME_USER"`), nil
+			})
+		}
+
+		Convey("should run commands via sudo", func() {
+			res, err := exec(WithBecome(conn, "", "balrog"), true)
+			So(err, ShouldBeNil)
+			So(res.Command, ShouldEqual, `echo "I am $SSHTEST_BECOME_USER"`)
+			So(res.Stdout, ShouldEqual, "I am balrog\n")
+			So(server.Commands()[0], ShouldStartWith, "sudo -S -p ")
+
+			Convey("and without a terminal", func() {
+				res, err := exec(WithBecome(conn, BecomeSudo, ""), false)
+				So(err, ShouldBeNil)
+				So(res.Stdout, ShouldEqual, "I am root\n")
+				So(res.Stderr, ShouldBeEmpty)
+			})
+		})
+
+		Convey("should run commands via su", func() {
+			res, err := exec(WithBecome(conn, BecomeSu, "balrog"), true)
+			So(err, ShouldBeNil)
+			So(res.Stdout, ShouldEqual, "I am balrog\n")
+			So(server.Commands()[0], ShouldStartWith, "LC_ALL=C su 'balrog' -c ")
+		})
+
+		Convey("should run commands as the login user via WithoutBecome()", func() {
+			res, err := exec(WithoutBecome(WithBecome(conn, "", "balrog")), true)
+			So(err, ShouldBeNil)
+			So(res.Stdout, ShouldEqual, "I am \n")
+			So(server.Commands(), ShouldResemble, []string{`echo "I am $SSHTEST_BECOME_USER"`})
+			So(WithoutBecome(conn), ShouldEqual, conn)
+		})
+
+		Convey("should fail when the password is wrong", func() {
+			inv.BecomePassword = "foe"
+			_, err := exec(WithBecome(conn, BecomeSudo, "balrog"), true)
+			So(err.Error(), ShouldEqual, "failed to become \"balrog\": incorrect become password")
+		})
+
+		Convey("should fail when the password is missing", func() {
+			inv.BecomePassword = ""
+			_, err := exec(WithBecome(conn, BecomeSudo, ""), true)
+			So(err.Error(), ShouldEqual, "failed to become \"root\": missing become password")
+		})
+	})
+}
@@ -0,0 +1,121 @@
+package transport
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/mihaitodor/wormhole/config"
+	"github.com/mihaitodor/wormhole/inventory"
+	"golang.org/x/sync/errgroup"
+)
+
+// dockerConnection runs commands inside a container via the docker CLI.
+// NB: Cancelling a command only kills the docker CLI, so the process keeps
+// running inside the container until it exits on its own.
+type dockerConnection struct {
+	Server  *inventory.Server
+	verbose bool
+}
+
+func (*dockerConnection) Close() error { return nil }
+
+// run executes the docker CLI with the arguments built by argv
+func (conn *dockerConnection) run(ctx context.Context, argv func(string) []string, fn ExecCallbackFunc) (*Result, error) {
+	sess, err := newLocalSession(ctx, argv, conn.verbose, conn.GetAddress())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new session: %s", err)
+	}
+
+	return execSession(ctx, sess, fn, conn.GetAddress())
+}
+
+// Exec runs a command inside the container. A pseudo terminal is never
+// attached, since docker requires one on our side as well.
+func (conn *dockerConnection) Exec(ctx context.Context, _ bool, fn ExecCallbackFunc) (*Result, error) {
+	return conn.run(ctx, func(command string) []string {
+		return []string{"docker", "exec", "-i", conn.Server.Container, "/bin/sh", "-c", command}
+	}, fn)
+}
+
+// CopyFile streams a tar archive containing the file to `docker cp`
+func (conn *dockerConnection) CopyFile(ctx context.Context, src io.Reader, size int64, dest, mode string) error {
+	perm, err := parseMode(mode)
+	if err != nil {
+		return err
+	}
+
+	target := conn.Server.Container + ":" + filepath.Dir(dest)
+	_, err = conn.run(ctx, func(string) []string {
+		return []string{"docker", "cp", "-", target}
+	}, func(sess *Session) (error, *errgroup.Group) {
+		err := sess.Start("docker cp - " + target)
+		if err != nil {
+			return fmt.Errorf("failed to start docker cp: %s", err), nil
+		}
+
+		var g errgroup.Group
+		g.Go(func() error {
+			defer sess.CloseStdin()
+
+			tw := tar.NewWriter(sess.Stdin())
+			err := tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     filepath.Base(dest),
+				Mode:     int64(perm),
+				Size:     size,
+				ModTime:  time.Now(),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to write tar header: %s", err)
+			}
+
+			_, err = io.Copy(tw, src)
+			if err != nil {
+				return fmt.Errorf("failed to write file contents: %s", err)
+			}
+
+			err = tw.Close()
+			if err != nil {
+				return fmt.Errorf("failed to close tar archive: %s", err)
+			}
+
+			return nil
+		})
+		return nil, &g
+	})
+
+	return err
+}
+
+func (conn *dockerConnection) GetAddress() string {
+	return conn.Server.GetAddress()
+}
+
+// GetHost returns the host on which the ports of the container are published
+func (conn *dockerConnection) GetHost() string {
+	if conn.Server.Host == "" {
+		return "localhost"
+	}
+
+	return conn.Server.Host
+}
+
+func (conn *dockerConnection) SetError(err error) {
+	conn.Server.SetError(err)
+}
+
+func (conn *dockerConnection) becomePassword() string {
+	return conn.Server.BecomePassword
+}
+
+func newDockerConnection(server *inventory.Server, conf config.Config) (*dockerConnection, error) {
+	if server.Container == "" {
+		return nil, fmt.Errorf("missing container name")
+	}
+
+	return &dockerConnection{Server: server, verbose: conf.Verbose}, nil
+}
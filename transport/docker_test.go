@@ -0,0 +1,100 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mihaitodor/wormhole/config"
+	"github.com/mihaitodor/wormhole/inventory"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/sync/errgroup"
+)
+
+func Test_dockerConnection(t *testing.T) {
+	Convey("dockerConnection", t, func() {
+		// Put the fake docker binary from the fixtures folder on PATH
+		fixtures, err := filepath.Abs("fixtures")
+		So(err, ShouldBeNil)
+		root, err := ioutil.TempDir("", "wormhole_docker")
+		So(err, ShouldBeNil)
+		So(os.Mkdir(filepath.Join(root, "rivendell"), 0755), ShouldBeNil)
+
+		path := os.Getenv("PATH")
+		os.Setenv("PATH", fixtures+string(os.PathListSeparator)+path)
+		os.Setenv("FAKE_DOCKER_ROOT", root)
+		Reset(func() {
+			os.Setenv("PATH", path)
+			os.Unsetenv("FAKE_DOCKER_ROOT")
+			So(os.RemoveAll(root), ShouldBeNil)
+		})
+
+		server := &inventory.Server{Connection: inventory.ConnectionDocker, Container: "rivendell"}
+		conn, err := NewConnection(server, config.Config{})
+		So(err, ShouldBeNil)
+		So(conn, ShouldHaveSameTypeAs, &dockerConnection{})
+
+		exec := func(cmd string) (*Result, error) {
+			return conn.Exec(context.Background(), true, func(sess *Session) (error, *errgroup.Group) {
+				return sess.Start(cmd), nil
+			})
+		}
+
+		calls := func() string {
+			calls, err := ioutil.ReadFile(filepath.Join(root, "calls"))
+			So(err, ShouldBeNil)
+			return string(calls)
+		}
+
+		Convey("should use the container name as address", func() {
+			So(conn.GetAddress(), ShouldEqual, "docker:rivendell")
+			So(conn.GetHost(), ShouldEqual, "localhost")
+		})
+
+		Convey("should run commands via docker exec", func() {
+			res, err := exec("echo out; echo err >&2")
+			So(err, ShouldBeNil)
+			So(res.Stdout, ShouldEqual, "out\n")
+			So(res.Stderr, ShouldEqual, "err\n")
+			So(calls(), ShouldEqual, "exec -i rivendell /bin/sh -c echo out; echo err >&2\n")
+		})
+
+		Convey("should return an ExitError for failed commands", func() {
+			res, err := exec("exit 4")
+			So(err, ShouldHaveSameTypeAs, &ExitError{})
+			So(res.ExitStatus, ShouldEqual, 4)
+		})
+
+		Convey("should report missing containers", func() {
+			server.Container = "moria"
+			_, err := exec("true")
+			So(err.Error(), ShouldContainSubstring, "No such container: moria")
+		})
+
+		Convey("should copy files via docker cp", func() {
+			contents := []byte("one ring to rule them all")
+			err := conn.CopyFile(context.Background(), bytes.NewReader(contents), int64(len(contents)), "/etc/ring.txt", "0600")
+			So(err, ShouldBeNil)
+			So(calls(), ShouldEqual, "cp - rivendell:/etc\n")
+
+			dest := filepath.Join(root, "rivendell", "etc", "ring.txt")
+			written, err := ioutil.ReadFile(dest)
+			So(err, ShouldBeNil)
+			So(written, ShouldResemble, contents)
+
+			stat, err := os.Stat(dest)
+			So(err, ShouldBeNil)
+			So(stat.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+		})
+	})
+
+	Convey("newDockerConnection()", t, func() {
+		Convey("should require a container name", func() {
+			_, err := NewConnection(&inventory.Server{Connection: inventory.ConnectionDocker}, config.Config{})
+			So(err.Error(), ShouldEqual, "missing container name")
+		})
+	})
+}
@@ -0,0 +1,162 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/mihaitodor/wormhole/config"
+	"github.com/mihaitodor/wormhole/inventory"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// knownHostsMutex serialises writes to the known_hosts file, since multiple
+// connections can be established in parallel
+var knownHostsMutex sync.Mutex
+
+// addKnownHost appends the key of a newly seen host to the known_hosts file
+func addKnownHost(knownHostsFile, hostname string, key ssh.PublicKey) error {
+	knownHostsMutex.Lock()
+	defer knownHostsMutex.Unlock()
+
+	f, err := os.OpenFile(knownHostsFile, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open known hosts file: %s", err)
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	if err != nil {
+		return fmt.Errorf("failed to write known hosts file: %s", err)
+	}
+
+	return nil
+}
+
+// hostKeyAlgorithmsFunc returns the host key algorithms to negotiate with
+// the server at address, or nil for the defaults
+type hostKeyAlgorithmsFunc func(address string) []string
+
+// hostKeyAlgorithmsOrder lists the host key types in the order in which the
+// ssh client prefers them
+var hostKeyAlgorithmsOrder = []string{
+	ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSA, ssh.KeyAlgoDSA, ssh.KeyAlgoED25519,
+}
+
+// probeKey is a public key which never matches any known host key
+type probeKey struct{}
+
+func (probeKey) Type() string                        { return "wormhole-probe" }
+func (probeKey) Marshal() []byte                     { return []byte("wormhole-probe") }
+func (probeKey) Verify([]byte, *ssh.Signature) error { return errors.New("probe key") }
+
+// knownHostKeyAlgorithms returns the types of the keys which are recorded in
+// known hosts for an address, so the server presents one of them instead of
+// its preferred key, which may not be known
+func knownHostKeyAlgorithms(callback ssh.HostKeyCallback) hostKeyAlgorithmsFunc {
+	return func(address string) []string {
+		// The probe key never matches, so the error lists all the known
+		// keys of the address
+		err := callback(address, &net.TCPAddr{}, probeKey{})
+		keyErr, ok := err.(*knownhosts.KeyError)
+		if !ok || len(keyErr.Want) == 0 {
+			return nil
+		}
+
+		known := make(map[string]bool, len(keyErr.Want))
+		for _, k := range keyErr.Want {
+			known[k.Key.Type()] = true
+		}
+
+		var algorithms []string
+		for _, algorithm := range hostKeyAlgorithmsOrder {
+			if known[algorithm] {
+				algorithms = append(algorithms, algorithm)
+				delete(known, algorithm)
+			}
+		}
+		var others []string
+		for algorithm := range known {
+			others = append(others, algorithm)
+		}
+		sort.Strings(others)
+
+		return append(algorithms, others...)
+	}
+}
+
+// newHostKeyCallback returns a host key callback which verifies server keys
+// against knownHostsFile according to the given host key checking policy and
+// a function which returns the host key algorithms of the known hosts
+func newHostKeyCallback(policy, knownHostsFile string) (ssh.HostKeyCallback, hostKeyAlgorithmsFunc, error) {
+	switch policy {
+	case config.HostKeyCheckingOff:
+		return ssh.InsecureIgnoreHostKey(), func(string) []string { return nil }, nil
+	case config.HostKeyCheckingStrict, config.HostKeyCheckingAcceptNew:
+	default:
+		return nil, nil, fmt.Errorf("unrecognised host key checking policy: %q", policy)
+	}
+
+	knownHostsFile, err := inventory.ExpandHome(knownHostsFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if policy == config.HostKeyCheckingAcceptNew {
+		// Make sure the known_hosts file exists so we can add new hosts to it
+		err = os.MkdirAll(filepath.Dir(knownHostsFile), 0700)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create known hosts folder: %s", err)
+		}
+		f, err := os.OpenFile(knownHostsFile, os.O_CREATE|os.O_RDONLY, 0600)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create known hosts file: %s", err)
+		}
+		f.Close()
+	}
+
+	callback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load known hosts: %s", err)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		keyErr, ok := err.(*knownhosts.KeyError)
+		if !ok {
+			return err
+		}
+
+		fingerprint := ssh.FingerprintSHA256(key)
+
+		if len(keyErr.Want) > 0 {
+			return fmt.Errorf(
+				"host key mismatch for %q: got %s key %s, which differs from the one in %s:%d."+
+					" Someone could be doing something nasty (man-in-the-middle attack)!",
+				hostname, key.Type(), fingerprint, keyErr.Want[0].Filename, keyErr.Want[0].Line,
+			)
+		}
+
+		if policy == config.HostKeyCheckingStrict {
+			return fmt.Errorf(
+				"unknown host %q with %s key %s: not found in %s",
+				hostname, key.Type(), fingerprint, knownHostsFile,
+			)
+		}
+
+		err = addKnownHost(knownHostsFile, hostname, key)
+		if err != nil {
+			return fmt.Errorf("failed to add host %q to known hosts: %s", hostname, err)
+		}
+		log.Infof("Added %s key %s of %q to the known hosts", key.Type(), fingerprint, hostname)
+
+		return nil
+	}, knownHostKeyAlgorithms(callback), nil
+}
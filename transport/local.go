@@ -0,0 +1,198 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/mihaitodor/wormhole/config"
+	"github.com/mihaitodor/wormhole/internal/procgroup"
+	"github.com/mihaitodor/wormhole/inventory"
+)
+
+// localProcess is a process which runs on the current machine
+type localProcess struct {
+	// argv builds the command line which executes the given shell command
+	argv   func(string) []string
+	stdin  *os.File
+	stdout io.Writer
+	stderr io.Writer
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+}
+
+func (p *localProcess) Start(command string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	args := p.argv(command)
+	p.cmd = exec.Command(args[0], args[1:]...)
+	p.cmd.Stdin = p.stdin
+	p.cmd.Stdout = p.stdout
+	p.cmd.Stderr = p.stderr
+	procgroup.Set(p.cmd)
+
+	err := p.cmd.Start()
+
+	// The child process has its own copy of the stdin pipe
+	p.stdin.Close()
+
+	return err
+}
+
+func (p *localProcess) Wait() error {
+	p.mu.Lock()
+	cmd := p.cmd
+	p.mu.Unlock()
+
+	if cmd == nil {
+		return errors.New("process not started")
+	}
+
+	return cmd.Wait()
+}
+
+// kill kills the process and its children, if it was started
+func (p *localProcess) kill() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cmd == nil || p.cmd.Process == nil {
+		return nil
+	}
+
+	return procgroup.Kill(p.cmd)
+}
+
+func (p *localProcess) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cmd == nil {
+		return p.stdin.Close()
+	}
+
+	return nil
+}
+
+// newLocalSession creates a session for a local process. There is no pseudo
+// terminal, so the process gets killed when ctx is cancelled.
+func newLocalSession(ctx context.Context, argv func(string) []string, verbose bool, address string) (*Session, error) {
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdin pipe: %s", err)
+	}
+
+	proc := &localProcess{argv: argv, stdin: stdinReader}
+	sess := newSession(ctx, proc, stdinWriter, proc.kill, verbose, address)
+	proc.stdout, proc.stderr = sess.outputWriters()
+
+	return sess, nil
+}
+
+// shellArgv runs the command via the local shell
+func shellArgv(command string) []string {
+	return []string{"/bin/sh", "-c", command}
+}
+
+// parseMode parses a file mode expressed as an octal string, such as "0644"
+func parseMode(mode string) (os.FileMode, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file mode %q: %s", mode, err)
+	}
+
+	return os.FileMode(perm), nil
+}
+
+// localConnection runs commands on the current machine
+type localConnection struct {
+	Server  *inventory.Server
+	verbose bool
+}
+
+func (*localConnection) Close() error { return nil }
+
+func (conn *localConnection) Exec(ctx context.Context, _ bool, fn ExecCallbackFunc) (*Result, error) {
+	sess, err := newLocalSession(ctx, shellArgv, conn.verbose, conn.GetAddress())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new session: %s", err)
+	}
+
+	return execSession(ctx, sess, fn, conn.GetAddress())
+}
+
+// CopyFile writes the contents of src to a temporary file next to dest and
+// then moves it in place, so dest never contains partial contents
+func (conn *localConnection) CopyFile(ctx context.Context, src io.Reader, size int64, dest, mode string) error {
+	perm, err := parseMode(mode)
+	if err != nil {
+		return err
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest)+".")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %s", err)
+	}
+	defer func() {
+		// Clean up if something went wrong before the rename
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	n, err := io.Copy(f, src)
+	if err != nil {
+		return fmt.Errorf("failed to write file contents: %s", err)
+	}
+	if n != size {
+		return fmt.Errorf("expected to write %d bytes, but wrote %d", size, n)
+	}
+
+	err = f.Chmod(perm)
+	if err != nil {
+		return fmt.Errorf("failed to set file mode: %s", err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close file: %s", err)
+	}
+
+	err = os.Rename(f.Name(), dest)
+	if err != nil {
+		return fmt.Errorf("failed to move file in place: %s", err)
+	}
+
+	return nil
+}
+
+func (conn *localConnection) GetAddress() string {
+	return conn.Server.GetAddress()
+}
+
+func (conn *localConnection) GetHost() string {
+	return conn.Server.GetAddress()
+}
+
+func (conn *localConnection) SetError(err error) {
+	conn.Server.SetError(err)
+}
+
+func (conn *localConnection) becomePassword() string {
+	return conn.Server.BecomePassword
+}
+
+func newLocalConnection(server *inventory.Server, conf config.Config) *localConnection {
+	return &localConnection{Server: server, verbose: conf.Verbose}
+}
@@ -0,0 +1,112 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mihaitodor/wormhole/config"
+	"github.com/mihaitodor/wormhole/inventory"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/sync/errgroup"
+)
+
+func Test_localConnection(t *testing.T) {
+	Convey("localConnection", t, func() {
+		server := &inventory.Server{Connection: inventory.ConnectionLocal}
+		conn, err := NewConnection(server, config.Config{})
+		So(err, ShouldBeNil)
+		So(conn, ShouldHaveSameTypeAs, &localConnection{})
+		Reset(func() { So(conn.Close(), ShouldBeNil) })
+
+		exec := func(ctx context.Context, cmd string) (*Result, error) {
+			return conn.Exec(ctx, true, func(sess *Session) (error, *errgroup.Group) {
+				return sess.Start(cmd), nil
+			})
+		}
+
+		Convey("should default to localhost", func() {
+			So(conn.GetAddress(), ShouldEqual, "localhost")
+			So(conn.GetHost(), ShouldEqual, "localhost")
+		})
+
+		Convey("should capture the command output", func() {
+			res, err := exec(context.Background(), "echo out; echo err >&2")
+			So(err, ShouldBeNil)
+			So(res.ExitStatus, ShouldEqual, 0)
+			So(res.Stdout, ShouldEqual, "out\n")
+			So(res.Stderr, ShouldEqual, "err\n")
+		})
+
+		Convey("should return an ExitError for failed commands", func() {
+			res, err := exec(context.Background(), "echo nope >&2; exit 3")
+			So(err, ShouldHaveSameTypeAs, &ExitError{})
+			So(res.ExitStatus, ShouldEqual, 3)
+			So(err.Error(), ShouldEqual, "command exited with status 3\nnope")
+		})
+
+		Convey("should feed stdin to the command", func() {
+			res, err := conn.Exec(context.Background(), false, func(sess *Session) (error, *errgroup.Group) {
+				err := sess.Start("cat")
+				if err != nil {
+					return err, nil
+				}
+
+				var g errgroup.Group
+				g.Go(func() error {
+					defer sess.CloseStdin()
+					_, err := sess.Stdin().Write([]byte("mellon"))
+					return err
+				})
+				return nil, &g
+			})
+			So(err, ShouldBeNil)
+			So(res.Stdout, ShouldEqual, "mellon")
+		})
+
+		Convey("should kill the command when cancelled", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			_, err := exec(ctx, "sleep 10")
+			So(err == context.DeadlineExceeded, ShouldBeTrue)
+			So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+		})
+
+		Convey("should copy files", func() {
+			dir, err := ioutil.TempDir("", "wormhole_local")
+			So(err, ShouldBeNil)
+			Reset(func() { So(os.RemoveAll(dir), ShouldBeNil) })
+
+			dest := filepath.Join(dir, "ring.txt")
+			contents := []byte("one ring to rule them all")
+			err = conn.CopyFile(context.Background(), bytes.NewReader(contents), int64(len(contents)), dest, "0600")
+			So(err, ShouldBeNil)
+
+			written, err := ioutil.ReadFile(dest)
+			So(err, ShouldBeNil)
+			So(written, ShouldResemble, contents)
+
+			stat, err := os.Stat(dest)
+			So(err, ShouldBeNil)
+			So(stat.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+
+			Convey("and reject invalid modes", func() {
+				err := conn.CopyFile(context.Background(), bytes.NewReader(nil), 0, dest, "rwx")
+				So(err.Error(), ShouldContainSubstring, "invalid file mode")
+			})
+		})
+	})
+
+	Convey("NewConnection()", t, func() {
+		Convey("should reject unrecognised connection types", func() {
+			_, err := NewConnection(&inventory.Server{Connection: "telnet"}, config.Config{})
+			So(err.Error(), ShouldContainSubstring, "unrecognised connection type")
+		})
+	})
+}
@@ -0,0 +1,110 @@
+package transport
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxCapturedOutput is the maximum number of bytes kept from each of the
+	// stdout and stderr streams of a remote process
+	maxCapturedOutput = 64 * 1024
+	// errorOutputLines is the number of output lines included in errors
+	errorOutputLines = 10
+)
+
+// tailBuffer is a writer which only keeps the last maxCapturedOutput bytes
+// written to it
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > maxCapturedOutput {
+		b.buf = b.buf[len(b.buf)-maxCapturedOutput:]
+	}
+
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return string(b.buf)
+}
+
+// cleanLine strips the carriage returns added by the pseudo terminal and the
+// NUL bytes sent by scp
+func cleanLine(line string) string {
+	return strings.Trim(line, "\r\x00")
+}
+
+// lastLines returns the last n non-empty lines of the given output
+func lastLines(output string, n int) []string {
+	var lines []string
+	for _, line := range strings.Split(output, "\n") {
+		line = cleanLine(line)
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	return lines
+}
+
+// lineLogger is a writer which logs every complete line written to it,
+// prefixed with the server address. Each line is logged in a single call,
+// so lines coming from different servers don't get interleaved.
+type lineLogger struct {
+	mu      sync.Mutex
+	address string
+	buf     bytes.Buffer
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.buf.Write(p)
+	for {
+		idx := bytes.IndexByte(l.buf.Bytes(), '\n')
+		if idx < 0 {
+			break
+		}
+
+		l.log(string(l.buf.Next(idx + 1)))
+	}
+
+	return len(p), nil
+}
+
+// Flush logs any incomplete line left in the buffer
+func (l *lineLogger) Flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.log(l.buf.String())
+	l.buf.Reset()
+}
+
+func (l *lineLogger) log(line string) {
+	line = cleanLine(strings.TrimSuffix(line, "\n"))
+	if line == "" {
+		return
+	}
+
+	log.Infof("[%s] %s", l.address, line)
+}
@@ -0,0 +1,66 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_tailBuffer(t *testing.T) {
+	Convey("tailBuffer", t, func() {
+		var b tailBuffer
+
+		Convey("should keep everything under the size limit", func() {
+			fmt.Fprint(&b, "one\ntwo\n")
+			So(b.String(), ShouldEqual, "one\ntwo\n")
+		})
+
+		Convey("should only keep the tail of large outputs", func() {
+			fmt.Fprint(&b, strings.Repeat("a", maxCapturedOutput))
+			fmt.Fprint(&b, "tail")
+			So(b.String(), ShouldHaveLength, maxCapturedOutput)
+			So(b.String(), ShouldEndWith, "atail")
+		})
+	})
+}
+
+func Test_lastLines(t *testing.T) {
+	Convey("lastLines()", t, func() {
+		Convey("should skip empty lines and strip carriage returns", func() {
+			So(lastLines("one\r\n\r\ntwo\r\n", 5), ShouldResemble, []string{"one", "two"})
+		})
+
+		Convey("should return at most n lines", func() {
+			So(lastLines("one\ntwo\nthree", 2), ShouldResemble, []string{"two", "three"})
+		})
+	})
+}
+
+func Test_lineLogger(t *testing.T) {
+	Convey("lineLogger", t, func() {
+		var output bytes.Buffer
+		log.SetOutput(&output)
+		Reset(func() { log.SetOutput(os.Stderr) })
+
+		l := lineLogger{address: "gondor:22"}
+
+		Convey("should only log complete lines", func() {
+			fmt.Fprint(&l, "hello ")
+			So(output.String(), ShouldBeEmpty)
+
+			fmt.Fprint(&l, "world\nbye")
+			So(output.String(), ShouldContainSubstring, "[gondor:22] hello world")
+			So(output.String(), ShouldNotContainSubstring, "bye")
+
+			Convey("and log the rest on Flush()", func() {
+				l.Flush()
+				So(output.String(), ShouldContainSubstring, "[gondor:22] bye")
+			})
+		})
+	})
+}
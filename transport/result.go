@@ -0,0 +1,81 @@
+package transport
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Result holds the outcome of a command executed via Connection.Exec
+type Result struct {
+	Command string
+	// ExitStatus is -1 if the command didn't report an exit status
+	ExitStatus int
+	// Signal is the name of the signal which terminated the command, if any
+	Signal string
+	// Stdout and Stderr only contain the tail of large outputs. Note that
+	// stderr is merged into stdout when a pseudo terminal is attached.
+	Stdout   string
+	Stderr   string
+	Duration time.Duration
+}
+
+// OutputTail returns the last few lines of stderr or, if the command didn't
+// write anything to it, the last few lines of stdout
+func (r *Result) OutputTail() string {
+	lines := lastLines(r.Stderr, errorOutputLines)
+	if len(lines) == 0 {
+		lines = lastLines(r.Stdout, errorOutputLines)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// ExitError is returned by Connection.Exec when the command exits with a
+// non-zero status or is terminated by a signal
+type ExitError struct {
+	Result *Result
+}
+
+func (e *ExitError) Error() string {
+	msg := fmt.Sprintf("command exited with status %d", e.Result.ExitStatus)
+	if e.Result.Signal != "" {
+		msg = fmt.Sprintf("command terminated by signal %s", e.Result.Signal)
+	}
+
+	if output := e.Result.OutputTail(); output != "" {
+		msg = fmt.Sprintf("%s\n%s", msg, output)
+	}
+
+	return msg
+}
+
+// newWaitError converts the error returned when waiting for a process to
+// finish and updates the result with the exit details
+func newWaitError(res *Result, err error) error {
+	switch e := err.(type) {
+	case *ssh.ExitError:
+		res.ExitStatus = e.ExitStatus()
+		res.Signal = e.Signal()
+		return &ExitError{Result: res}
+	case *exec.ExitError:
+		res.ExitStatus = -1
+		if status, ok := e.Sys().(syscall.WaitStatus); ok {
+			res.ExitStatus = status.ExitStatus()
+			if status.Signaled() {
+				res.Signal = status.Signal().String()
+			}
+		}
+		return &ExitError{Result: res}
+	case *ssh.ExitMissingError:
+		res.ExitStatus = -1
+		return fmt.Errorf("connection lost: %s", err)
+	default:
+		res.ExitStatus = -1
+		return fmt.Errorf("failed command: %s", err)
+	}
+}
@@ -0,0 +1,243 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/mihaitodor/wormhole/config"
+	"github.com/mihaitodor/wormhole/inventory"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sync/errgroup"
+)
+
+type sshConnection struct {
+	Server      *inventory.Server
+	client      *ssh.Client
+	jumpClients []*ssh.Client
+	verbose     bool
+}
+
+func (conn *sshConnection) Close() error {
+	err := conn.client.Close()
+
+	// Tear down the tunnels in reverse order
+	for i := len(conn.jumpClients) - 1; i >= 0; i-- {
+		jumpErr := conn.jumpClients[i].Close()
+		if jumpErr != nil && err == nil {
+			err = fmt.Errorf("failed to close jump host connection: %s", jumpErr)
+		}
+	}
+
+	return err
+}
+
+// newSession creates a new ssh session
+func (conn *sshConnection) newSession(ctx context.Context, withTerminal bool) (*Session, error) {
+	sshSess, err := conn.client.NewSession()
+	if err != nil {
+		conn.client.Close()
+		return nil, fmt.Errorf("failed to initialise session: %s", err)
+	}
+
+	stdin, err := sshSess.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the session stdin pipe: %s", err)
+	}
+
+	// Request a pseudo terminal for forwarding signals to the remote process
+	// NB: scp misbehaves when a pseudoterminal is attached, but we need one
+	// to cancel other commands...
+	var interrupt func() error
+	if withTerminal {
+		err = sshSess.RequestPty("xterm", 80, 40,
+			ssh.TerminalModes{
+				ssh.ECHO:          0,     // disable echoing
+				ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
+				ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
+			},
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup the pseudo terminal: %s", err)
+		}
+
+		interrupt = func() error {
+			// Looks like ssh.SIGINT is not supported by OpenSSH. What a bummer :(
+			// https://github.com/golang/go/issues/4115#issuecomment-66070418
+			// https://github.com/golang/go/issues/16597
+			// err := sshSess.Signal(ssh.SIGINT)
+			_, err := stdin.Write([]byte("\x03"))
+			return err
+		}
+	}
+
+	sess := newSession(ctx, sshSess, stdin, interrupt, conn.verbose, conn.GetAddress())
+	sshSess.Stdout, sshSess.Stderr = sess.outputWriters()
+
+	return sess, nil
+}
+
+func (conn *sshConnection) Exec(ctx context.Context, withTerminal bool, fn ExecCallbackFunc) (*Result, error) {
+	sess, err := conn.newSession(ctx, withTerminal)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new session: %s", err)
+	}
+
+	return execSession(ctx, sess, fn, conn.GetAddress())
+}
+
+// scpCopy sends the contents of src to a remote scp receiver
+func scpCopy(sess *Session, src io.Reader, size int64, dest, mode string) error {
+	// Instruct the remote scp process that we want to bail out immediately
+	defer func() {
+		err := sess.CloseStdin()
+		if err != nil {
+			log.Warnf("Failed to close session stdin: %s", err)
+		}
+	}()
+
+	_, err := fmt.Fprintln(sess.Stdin(), "C"+mode, size, filepath.Base(dest))
+	if err != nil {
+		return fmt.Errorf("failed to create remote file: %s", err)
+	}
+
+	_, err = io.Copy(sess.Stdin(), src)
+	if err != nil {
+		return fmt.Errorf("failed to write remote file contents: %s", err)
+	}
+
+	_, err = fmt.Fprint(sess.Stdin(), "\x00")
+	if err != nil {
+		return fmt.Errorf("failed to close remote file: %s", err)
+	}
+
+	return nil
+}
+
+// CopyFile copies the contents of src to dest on the remote host using scp
+func (conn *sshConnection) CopyFile(ctx context.Context, src io.Reader, size int64, dest, mode string) error {
+	_, err := conn.Exec(ctx, false, func(sess *Session) (error, *errgroup.Group) {
+		// Start scp receiver on the remote host
+		err := sess.Start("scp -qt " + filepath.Dir(dest))
+		if err != nil {
+			return fmt.Errorf("failed to start scp receiver: %s", err), nil
+		}
+
+		var g errgroup.Group
+		g.Go(func() error {
+			return scpCopy(sess, src, size, dest, mode)
+		})
+		return nil, &g
+	})
+
+	return err
+}
+
+func (conn *sshConnection) GetAddress() string {
+	return conn.Server.GetAddress()
+}
+
+func (conn *sshConnection) GetHost() string {
+	return conn.Server.Host
+}
+
+func (conn *sshConnection) SetError(err error) {
+	conn.Server.SetError(err)
+}
+
+func (conn *sshConnection) becomePassword() string {
+	return conn.Server.BecomePassword
+}
+
+// dial establishes a ssh connection to the given server. If via is not nil,
+// the connection is tunnelled through it using a direct-tcpip channel.
+func dial(server *inventory.Server, via *ssh.Client, hostKeyCallback ssh.HostKeyCallback, hostKeyAlgorithms hostKeyAlgorithmsFunc, timeout time.Duration) (*ssh.Client, error) {
+	auth, agentConn, err := authMethods(server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up authentication: %s", err)
+	}
+	if agentConn != nil {
+		// The ssh-agent is only needed during the handshake
+		defer agentConn.Close()
+	}
+
+	sshConfig := &ssh.ClientConfig{
+		User:            server.Username,
+		Auth:            auth,
+		Timeout:         timeout,
+		HostKeyCallback: hostKeyCallback,
+		// Only negotiate the key types which are known for the server, if
+		// any, so it doesn't present another one and fail the verification
+		HostKeyAlgorithms: hostKeyAlgorithms(server.GetAddress()),
+	}
+
+	if via == nil {
+		client, err := ssh.Dial("tcp", server.GetAddress(), sshConfig)
+		if err != nil {
+			return nil, fmt.Errorf("dial error: %s", err)
+		}
+
+		return client, nil
+	}
+
+	tunnel, err := via.Dial("tcp", server.GetAddress())
+	if err != nil {
+		return nil, fmt.Errorf("tunnel dial error: %s", err)
+	}
+
+	// The ssh client only applies the timeout to the TCP connection, so we
+	// need to enforce it ourselves for the handshake
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() { tunnel.Close() })
+		defer timer.Stop()
+	}
+
+	clientConn, chans, reqs, err := ssh.NewClientConn(tunnel, server.GetAddress(), sshConfig)
+	if err != nil {
+		tunnel.Close()
+		return nil, fmt.Errorf("handshake error: %s", err)
+	}
+
+	return ssh.NewClient(clientConn, chans, reqs), nil
+}
+
+func newSSHConnection(server *inventory.Server, conf config.Config) (*sshConnection, error) {
+	hostKeyCallback, hostKeyAlgorithms, err := newHostKeyCallback(conf.HostKeyChecking, conf.KnownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up host key checking: %s", err)
+	}
+
+	// Hop through the jump hosts, if any, in the order in which they are listed
+	var jumpClients []*ssh.Client
+	closeJumpClients := func() {
+		for i := len(jumpClients) - 1; i >= 0; i-- {
+			jumpClients[i].Close()
+		}
+	}
+
+	var via *ssh.Client
+	for _, jumpHost := range server.Jump {
+		via, err = dial(jumpHost, via, hostKeyCallback, hostKeyAlgorithms, conf.ConnectTimeout)
+		if err != nil {
+			closeJumpClients()
+			return nil, fmt.Errorf("failed to connect to jump host %q: %s", jumpHost.GetAddress(), err)
+		}
+		jumpClients = append(jumpClients, via)
+	}
+
+	client, err := dial(server, via, hostKeyCallback, hostKeyAlgorithms, conf.ConnectTimeout)
+	if err != nil {
+		closeJumpClients()
+		return nil, err
+	}
+
+	return &sshConnection{
+		Server:      server,
+		client:      client,
+		jumpClients: jumpClients,
+		verbose:     conf.Verbose,
+	}, nil
+}
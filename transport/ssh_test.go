@@ -0,0 +1,259 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mihaitodor/wormhole/config"
+	"github.com/mihaitodor/wormhole/inventory"
+	"github.com/mihaitodor/wormhole/transport/sshtest"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/sync/errgroup"
+)
+
+func Test_sshConnection(t *testing.T) {
+	Convey("sshConnection", t, func() {
+		server, err := sshtest.NewServer("gandalf", "mellon")
+		So(err, ShouldBeNil)
+
+		conn, err := NewConnection(server.Inventory(), config.Config{
+			ConnectTimeout:  500 * time.Millisecond,
+			HostKeyChecking: config.HostKeyCheckingOff,
+		})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			So(conn.Close(), ShouldBeNil)
+			So(server.Close(), ShouldBeNil)
+		})
+
+		exec := func(ctx context.Context, withTerminal bool, cmd string) (*Result, error) {
+			return conn.Exec(ctx, withTerminal, func(sess *Session) (error, *errgroup.Group) {
+				return sess.Start(cmd), nil
+			})
+		}
+
+		Convey("should capture the command output", func() {
+			res, err := exec(context.Background(), false, "echo out; echo err >&2")
+			So(err, ShouldBeNil)
+			So(res.Stdout, ShouldEqual, "out\n")
+			So(res.Stderr, ShouldEqual, "err\n")
+			So(server.Commands(), ShouldResemble, []string{"echo out; echo err >&2"})
+		})
+
+		Convey("should merge stderr into stdout when a terminal is attached", func() {
+			res, err := exec(context.Background(), true, "echo out; echo err >&2")
+			So(err, ShouldBeNil)
+			So(res.Stdout, ShouldEqual, "out\nerr\n")
+			So(res.Stderr, ShouldBeEmpty)
+		})
+
+		Convey("should return an ExitError for failed commands", func() {
+			res, err := exec(context.Background(), false, "echo nope >&2; exit 3")
+			So(err, ShouldHaveSameTypeAs, &ExitError{})
+			So(res.ExitStatus, ShouldEqual, 3)
+			So(err.Error(), ShouldEqual, "command exited with status 3\nnope")
+		})
+
+		Convey("should interrupt the command when cancelled", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			_, err := exec(ctx, true, "sleep 10")
+			So(err == context.DeadlineExceeded, ShouldBeTrue)
+			So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+		})
+
+		Convey("should copy files via scp", func() {
+			So(os.Mkdir(filepath.Join(server.Root, "etc"), 0755), ShouldBeNil)
+
+			contents := []byte("one ring to rule them all")
+			err := conn.CopyFile(context.Background(), bytes.NewReader(contents), int64(len(contents)), "etc/ring.txt", "0600")
+			So(err, ShouldBeNil)
+			So(server.Commands(), ShouldResemble, []string{"scp -qt etc"})
+
+			dest := filepath.Join(server.Root, "etc", "ring.txt")
+			written, err := ioutil.ReadFile(dest)
+			So(err, ShouldBeNil)
+			So(written, ShouldResemble, contents)
+
+			stat, err := os.Stat(dest)
+			So(err, ShouldBeNil)
+			So(stat.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+
+			Convey("and accept absolute paths under the root folder", func() {
+				dest := filepath.Join(server.Root, "etc", "ring.bak")
+				err := conn.CopyFile(context.Background(), bytes.NewReader(contents), int64(len(contents)), dest, "0600")
+				So(err, ShouldBeNil)
+
+				written, err := ioutil.ReadFile(dest)
+				So(err, ShouldBeNil)
+				So(written, ShouldResemble, contents)
+			})
+
+			Convey("and fail when the folder is missing", func() {
+				err := conn.CopyFile(context.Background(), bytes.NewReader(contents), int64(len(contents)), "mordor/ring.txt", "0600")
+				So(err.Error(), ShouldContainSubstring, "scp: mordor: No such file or directory")
+			})
+
+			Convey("and refuse to write outside of the root folder", func() {
+				err := conn.CopyFile(context.Background(), bytes.NewReader(contents), int64(len(contents)), "/etc/ring.txt", "0600")
+				So(err.Error(), ShouldContainSubstring, "scp: /etc: outside of the sshtest root folder")
+			})
+		})
+	})
+}
+
+func Test_NewConnectionCredentials(t *testing.T) {
+	Convey("NewConnection()", t, func() {
+		server, err := sshtest.NewServer("gandalf", "mellon")
+		So(err, ShouldBeNil)
+		Reset(func() { So(server.Close(), ShouldBeNil) })
+
+		conf := config.Config{
+			ConnectTimeout:  500 * time.Millisecond,
+			HostKeyChecking: config.HostKeyCheckingOff,
+		}
+		inv := server.Inventory()
+		inv.Password = ""
+		inv.PasswordFrom = &inventory.CredentialSource{Command: "echo mellon"}
+
+		Convey("should use the password resolved by the inventory", func() {
+			So(inventory.Inventory{inv}.ResolveCredentials(), ShouldBeNil)
+			conn, err := NewConnection(inv, conf)
+			So(err, ShouldBeNil)
+			So(conn.Close(), ShouldBeNil)
+		})
+
+		Convey("should not read the password source itself", func() {
+			_, err := NewConnection(inv, conf)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "unable to authenticate")
+		})
+	})
+}
+
+func Test_sshConnectionJump(t *testing.T) {
+	Convey("NewConnection() with jump hosts", t, func() {
+		var servers []*sshtest.Server
+		for _, username := range []string{"bilbo", "frodo", "gandalf"} {
+			server, err := sshtest.NewServer(username, "mellon")
+			So(err, ShouldBeNil)
+			servers = append(servers, server)
+		}
+		Reset(func() {
+			for _, server := range servers {
+				So(server.Close(), ShouldBeNil)
+			}
+		})
+		first, second, target := servers[0], servers[1], servers[2]
+
+		conf := config.Config{
+			ConnectTimeout:  500 * time.Millisecond,
+			HostKeyChecking: config.HostKeyCheckingOff,
+		}
+		inv := target.Inventory()
+
+		Convey("should tunnel the connection through the jump host", func() {
+			inv.Jump = []*inventory.Server{first.Inventory()}
+			conn, err := NewConnection(inv, conf)
+			So(err, ShouldBeNil)
+
+			res, err := conn.Exec(context.Background(), false, func(sess *Session) (error, *errgroup.Group) {
+				return sess.Start("echo hello"), nil
+			})
+			So(err, ShouldBeNil)
+			So(res.Stdout, ShouldEqual, "hello\n")
+			So(conn.Close(), ShouldBeNil)
+
+			So(target.Commands(), ShouldResemble, []string{"echo hello"})
+			So(first.Commands(), ShouldBeEmpty)
+			So(first.Forwards(), ShouldResemble, []string{target.Inventory().GetAddress()})
+		})
+
+		Convey("should hop through the jump hosts in order", func() {
+			inv.Jump = []*inventory.Server{first.Inventory(), second.Inventory()}
+			conn, err := NewConnection(inv, conf)
+			So(err, ShouldBeNil)
+
+			res, err := conn.Exec(context.Background(), false, func(sess *Session) (error, *errgroup.Group) {
+				return sess.Start("whoami"), nil
+			})
+			So(err, ShouldBeNil)
+			So(res.ExitStatus, ShouldEqual, 0)
+			So(conn.Close(), ShouldBeNil)
+
+			So(first.Forwards(), ShouldResemble, []string{second.Inventory().GetAddress()})
+			So(second.Forwards(), ShouldResemble, []string{target.Inventory().GetAddress()})
+			So(target.Commands(), ShouldResemble, []string{"whoami"})
+		})
+
+		Convey("should fail when the jump host rejects the credentials", func() {
+			jump := first.Inventory()
+			jump.Password = "friend"
+			inv.Jump = []*inventory.Server{jump}
+
+			_, err := NewConnection(inv, conf)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "failed to connect to jump host")
+			So(first.Forwards(), ShouldBeEmpty)
+			So(target.Commands(), ShouldBeEmpty)
+		})
+
+		Convey("should fail when the target is unreachable from the jump host", func() {
+			inv.Jump = []*inventory.Server{first.Inventory()}
+			inv.Port = 1
+
+			_, err := NewConnection(inv, conf)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "tunnel dial error")
+		})
+	})
+}
+
+func Test_sshConnectionKnownHosts(t *testing.T) {
+	Convey("NewConnection() with strict host key checking", t, func() {
+		server, err := sshtest.NewServer("gandalf", "mellon")
+		So(err, ShouldBeNil)
+		Reset(func() { So(server.Close(), ShouldBeNil) })
+
+		dir, err := ioutil.TempDir("", "wormhole_known_hosts")
+		So(err, ShouldBeNil)
+		Reset(func() { So(os.RemoveAll(dir), ShouldBeNil) })
+
+		knownHostsFile := filepath.Join(dir, "known_hosts")
+		conf := config.Config{
+			ConnectTimeout:  500 * time.Millisecond,
+			HostKeyChecking: config.HostKeyCheckingStrict,
+			KnownHostsFile:  knownHostsFile,
+		}
+		address := knownhosts.Normalize(server.Inventory().GetAddress())
+
+		// The server prefers its ecdsa key, but offers an ed25519 one too
+		for _, key := range server.HostKeys {
+			key := key
+			Convey("should negotiate the "+key.Type()+" key when it's the only known one", func() {
+				line := knownhosts.Line([]string{address}, key)
+				So(ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0600), ShouldBeNil)
+
+				conn, err := NewConnection(server.Inventory(), conf)
+				So(err, ShouldBeNil)
+				So(conn.Close(), ShouldBeNil)
+			})
+		}
+
+		Convey("should reject the server when none of its keys are known", func() {
+			So(ioutil.WriteFile(knownHostsFile, nil, 0600), ShouldBeNil)
+
+			_, err := NewConnection(server.Inventory(), conf)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "unknown host")
+		})
+	})
+}
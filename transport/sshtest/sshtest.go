@@ -0,0 +1,618 @@
+// Package sshtest provides an in-process ssh server for end-to-end tests.
+//
+// Commands are executed via the local shell on the real filesystem, with the
+// temporary Root folder as their working directory. Files sent via scp follow
+// the same rules, so tests should use paths relative to Root. Absolute scp
+// targets outside of Root are rejected, to avoid clobbering the host. TMPDIR
+// points to the tmp folder under Root.
+//
+// The commands find fake sudo and su executables on their PATH, which check
+// the password against BecomePassword and then run the command as the
+// current user, with SSHTEST_BECOME_USER set to the requested user. Tests
+// can add more fake executables, such as apt-get, via AddCommand.
+package sshtest
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/mihaitodor/wormhole/internal/procgroup"
+	"github.com/mihaitodor/wormhole/inventory"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// Server is a ssh server listening on a random local port
+type Server struct {
+	Host     string
+	Port     uint
+	Username string
+	Password string
+	// Root is the working directory of the executed commands and of the scp
+	// receiver. It is removed by Close().
+	Root string
+	// BecomePassword is the password expected by the fake sudo and su
+	BecomePassword string
+	// HostKeys are the ecdsa and ed25519 public keys of the server
+	HostKeys []ssh.PublicKey
+
+	// bin holds the fake sudo and su executables
+	bin      string
+	listener net.Listener
+	config   *ssh.ServerConfig
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	commands []string
+	forwards []string
+}
+
+// NewServer starts a ssh server which accepts the given credentials
+func NewServer(username, password string) (*Server, error) {
+	signers, err := newHostKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := ioutil.TempDir("", "wormhole_sshtest")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create root folder: %s", err)
+	}
+
+	err = os.Mkdir(filepath.Join(root, "tmp"), 0777|os.ModeSticky)
+	if err != nil {
+		os.RemoveAll(root)
+		return nil, fmt.Errorf("failed to create tmp folder: %s", err)
+	}
+
+	bin, err := writeFakeBinaries()
+	if err != nil {
+		os.RemoveAll(root)
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		os.RemoveAll(root)
+		os.RemoveAll(bin)
+		return nil, fmt.Errorf("failed to listen: %s", err)
+	}
+
+	s := &Server{
+		Host:     "127.0.0.1",
+		Port:     uint(listener.Addr().(*net.TCPAddr).Port),
+		Username: username,
+		Password: password,
+		Root:     root,
+		bin:      bin,
+		listener: listener,
+		conns:    make(map[net.Conn]struct{}),
+	}
+
+	s.config = &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if meta.User() == s.Username && string(pass) == s.Password {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %q", meta.User())
+		},
+	}
+	for _, signer := range signers {
+		s.config.AddHostKey(signer)
+		s.HostKeys = append(s.HostKeys, signer.PublicKey())
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s, nil
+}
+
+// newHostKeys generates an ecdsa and an ed25519 host key
+func newHostKeys() ([]ssh.Signer, error) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ecdsa host key: %s", err)
+	}
+
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ed25519 host key: %s", err)
+	}
+
+	var signers []ssh.Signer
+	for _, key := range []interface{}{ecdsaKey, ed25519Key} {
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create host key signer: %s", err)
+		}
+		signers = append(signers, signer)
+	}
+
+	return signers, nil
+}
+
+// Inventory returns the inventory entry for connecting to the server
+func (s *Server) Inventory() *inventory.Server {
+	return &inventory.Server{
+		Host:     s.Host,
+		Port:     s.Port,
+		Username: s.Username,
+		Password: s.Password,
+	}
+}
+
+// Commands returns the commands which were executed so far, in order
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.commands...)
+}
+
+// Forwards returns the destination addresses of the direct-tcpip channels
+// which were opened so far, in order
+func (s *Server) Forwards() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.forwards...)
+}
+
+// AddCommand writes a fake executable called name, which runs script via
+// /bin/sh, to the PATH of the commands
+func (s *Server) AddCommand(name, script string) error {
+	err := ioutil.WriteFile(filepath.Join(s.bin, name), []byte("#!/bin/sh\n"+script), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to write fake %s: %s", name, err)
+	}
+
+	return nil
+}
+
+// Close shuts down the server, drops all connections and removes Root
+func (s *Server) Close() error {
+	err := s.listener.Close()
+
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	for _, dir := range []string{s.Root, s.bin} {
+		rmErr := os.RemoveAll(dir)
+		if rmErr != nil && err == nil {
+			err = rmErr
+		}
+	}
+
+	return err
+}
+
+const fakeSudo = `#!/bin/sh
+# sudo -S -p <prompt> -u <user> -- <command>...
+while [ "$1" != "--" ]; do
+	case "$1" in
+	-p) prompt="$2"; shift ;;
+	-u) user="$2"; shift ;;
+	esac
+	shift
+done
+shift
+
+for attempt in 1 2 3; do
+	printf '%s' "$prompt" >&2
+	read -r password || { echo "sudo: no password was provided" >&2; exit 1; }
+	if [ "$password" = "$SSHTEST_BECOME_PASSWORD" ]; then
+		SSHTEST_BECOME_USER="$user" exec "$@"
+	fi
+	echo "Sorry, try again." >&2
+done
+
+echo "sudo: 3 incorrect password attempts" >&2
+exit 1
+`
+
+const fakeSu = `#!/bin/sh
+# su <user> -c <command>
+printf 'Password: '
+read -r password
+if [ "$password" != "$SSHTEST_BECOME_PASSWORD" ]; then
+	echo "su: Authentication failure" >&2
+	exit 1
+fi
+
+SSHTEST_BECOME_USER="$1" exec /bin/sh -c "$3"
+`
+
+// writeFakeBinaries writes the fake sudo and su to a temporary folder
+func writeFakeBinaries() (string, error) {
+	bin, err := ioutil.TempDir("", "wormhole_sshtest_bin")
+	if err != nil {
+		return "", fmt.Errorf("failed to create bin folder: %s", err)
+	}
+
+	for name, contents := range map[string]string{"sudo": fakeSudo, "su": fakeSu} {
+		err = ioutil.WriteFile(filepath.Join(bin, name), []byte(contents), 0755)
+		if err != nil {
+			os.RemoveAll(bin)
+			return "", fmt.Errorf("failed to write fake %s: %s", name, err)
+		}
+	}
+
+	return bin, nil
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	var wg sync.WaitGroup
+	for newChannel := range chans {
+		if newChannel.ChannelType() == "direct-tcpip" {
+			wg.Add(1)
+			go func(newChannel ssh.NewChannel) {
+				defer wg.Done()
+				s.forward(newChannel)
+			}(newChannel)
+			continue
+		}
+
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handleSession(channel, requests)
+		}()
+	}
+	wg.Wait()
+}
+
+// handleSession serves a single exec request on a session channel
+func (s *Server) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	withTerminal := false
+	for req := range requests {
+		switch req.Type {
+		case "pty-req":
+			withTerminal = true
+			req.Reply(true, nil)
+		case "env":
+			req.Reply(true, nil)
+		case "exec":
+			var payload struct{ Command string }
+			err := ssh.Unmarshal(req.Payload, &payload)
+			if err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+
+			s.mu.Lock()
+			s.commands = append(s.commands, payload.Command)
+			s.mu.Unlock()
+
+			go ssh.DiscardRequests(requests)
+
+			if dir, ok := scpSinkDir(payload.Command); ok {
+				s.scpSink(channel, dir)
+			} else {
+				s.run(channel, payload.Command, withTerminal)
+			}
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// forward connects a direct-tcpip channel to its destination address
+func (s *Server) forward(newChannel ssh.NewChannel) {
+	// See RFC 4254, section 7.2
+	var payload struct {
+		DestHost   string
+		DestPort   uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	err := ssh.Unmarshal(newChannel.ExtraData(), &payload)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "invalid direct-tcpip payload")
+		return
+	}
+
+	addr := net.JoinHostPort(payload.DestHost, strconv.FormatUint(uint64(payload.DestPort), 10))
+	dest, err := net.Dial("tcp", addr)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer dest.Close()
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
+
+	s.mu.Lock()
+	s.forwards = append(s.forwards, addr)
+	s.mu.Unlock()
+
+	// Tear down both ends as soon as either of them is done
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(dest, channel)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(channel, dest)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func sendExitStatus(channel ssh.Channel, status int) {
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+}
+
+func sendExitSignal(channel ssh.Channel, signal string) {
+	channel.SendRequest("exit-signal", false, ssh.Marshal(struct {
+		Signal     string
+		CoreDumped bool
+		Error      string
+		Lang       string
+	}{Signal: signal}))
+}
+
+// run executes the command via the local shell. When a pseudo terminal was
+// requested, stderr is merged into stdout and a ^C on stdin interrupts the
+// command, just like the terminal line discipline would.
+func (s *Server) run(channel ssh.Channel, command string, withTerminal bool) {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Dir = s.Root
+	cmd.Env = append(os.Environ(),
+		"PATH="+s.bin+string(os.PathListSeparator)+os.Getenv("PATH"),
+		"SSHTEST_BECOME_PASSWORD="+s.BecomePassword,
+		"TMPDIR="+filepath.Join(s.Root, "tmp"),
+	)
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+	if withTerminal {
+		cmd.Stderr = channel
+	}
+	procgroup.Set(cmd)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		fmt.Fprintf(channel.Stderr(), "sshtest: %s\n", err)
+		sendExitStatus(channel, 255)
+		return
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		fmt.Fprintf(channel.Stderr(), "sshtest: %s\n", err)
+		sendExitStatus(channel, 127)
+		return
+	}
+
+	interrupted := make(chan struct{})
+	go func() {
+		defer stdin.Close()
+
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := channel.Read(buf)
+			data := buf[:n]
+			if withTerminal {
+				if i := strings.IndexByte(string(data), '\x03'); i >= 0 {
+					stdin.Write(data[:i])
+					close(interrupted)
+					procgroup.Kill(cmd)
+					return
+				}
+			}
+			if len(data) > 0 {
+				_, werr := stdin.Write(data)
+				if werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	err = cmd.Wait()
+
+	select {
+	case <-interrupted:
+		sendExitSignal(channel, "INT")
+		return
+	default:
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			sendExitStatus(channel, status.ExitStatus())
+			return
+		}
+	}
+	if err != nil {
+		sendExitStatus(channel, 255)
+		return
+	}
+
+	sendExitStatus(channel, 0)
+}
+
+// scpSinkDir returns the target folder of `scp -t` commands
+func scpSinkDir(command string) (string, bool) {
+	args := strings.Fields(command)
+	if len(args) < 3 || args[0] != "scp" || !strings.Contains(args[len(args)-2], "t") {
+		return "", false
+	}
+
+	return args[len(args)-1], true
+}
+
+// scpSink implements the receiving end of the scp protocol for regular files
+func (s *Server) scpSink(channel ssh.Channel, dir string) {
+	fail := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf("scp: "+format, args...)
+		fmt.Fprintf(channel, "\x01%s\n", msg)
+		fmt.Fprintln(channel.Stderr(), msg)
+		sendExitStatus(channel, 1)
+	}
+
+	target := dir
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(s.Root, target)
+	}
+	if rel, err := filepath.Rel(s.Root, target); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		fail("%s: outside of the sshtest root folder", dir)
+		return
+	}
+
+	stat, err := os.Stat(target)
+	if err != nil || !stat.IsDir() {
+		fail("%s: No such file or directory", dir)
+		return
+	}
+
+	r := bufio.NewReader(channel)
+	channel.Write([]byte{0})
+
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		}
+		if err != nil {
+			fail("failed to read file header: %s", err)
+			return
+		}
+
+		// C<mode> <size> <name>
+		fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 3)
+		if len(fields) != 3 || !strings.HasPrefix(fields[0], "C") {
+			fail("unsupported header: %q", line)
+			return
+		}
+
+		mode, err := strconv.ParseUint(fields[0][1:], 8, 32)
+		if err != nil {
+			fail("invalid mode: %q", fields[0][1:])
+			return
+		}
+
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			fail("invalid size: %q", fields[1])
+			return
+		}
+
+		channel.Write([]byte{0})
+
+		err = writeFile(filepath.Join(target, fields[2]), io.LimitReader(r, size), size, os.FileMode(mode))
+		if err != nil {
+			fail("%s", err)
+			return
+		}
+
+		// Each file is followed by a null byte
+		end, err := r.ReadByte()
+		if err != nil || end != 0 {
+			fail("missing end of file marker")
+			return
+		}
+
+		channel.Write([]byte{0})
+	}
+
+	sendExitStatus(channel, 0)
+}
+
+func writeFile(path string, r io.Reader, size int64, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("%s: expected %d bytes, got %d", path, size, n)
+	}
+
+	err = f.Chmod(mode)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
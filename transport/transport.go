@@ -7,28 +7,56 @@ import (
 	"sync"
 	"time"
 
+	"github.com/mihaitodor/wormhole/config"
 	"github.com/mihaitodor/wormhole/inventory"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/crypto/ssh"
 	"golang.org/x/sync/errgroup"
 )
 
-// Session is a wrapper around ssh.Session
+// process is a command which runs on a remote server or locally
+type process interface {
+	Start(cmd string) error
+	Wait() error
+	Close() error
+}
+
+// Session is a wrapper around a process, such as a ssh.Session
 type Session struct {
-	sshSess               *ssh.Session
+	proc                  process
 	onceStdinCloser       sync.Once
 	stdin                 io.WriteCloser
+	stdout                tailBuffer
+	stderr                tailBuffer
+	loggers               []*lineLogger
+	outputs               []*outputFilter
+	interrupt             func() error
 	sigintHandlerQuitChan chan struct{}
+	become                *Become
+	responder             *becomeResponder
+	command               string
+	started               time.Time
 }
 
 // Start starts a remote process in the current session
 func (s *Session) Start(cmd string) error {
-	return s.sshSess.Start(cmd)
+	s.command = cmd
+	s.started = time.Now()
+
+	if s.become != nil {
+		cmd, s.responder = s.become.wrap(s, cmd)
+	}
+
+	return s.proc.Start(cmd)
+}
+
+// setBecome makes the session run its command as a different user
+func (s *Session) setBecome(b *Become) {
+	s.become = b
 }
 
 // wait blocks until the remote process completes or is cancelled
 func (s *Session) wait() error {
-	return s.sshSess.Wait()
+	return s.proc.Wait()
 }
 
 // Stdin returns a pipe to the stdin of the remote process
@@ -45,6 +73,71 @@ func (s *Session) CloseStdin() error {
 	return err
 }
 
+// Stdout returns the tail of the captured stdout of the remote process
+func (s *Session) Stdout() string {
+	return s.stdout.String()
+}
+
+// Stderr returns the tail of the captured stderr of the remote process
+func (s *Session) Stderr() string {
+	return s.stderr.String()
+}
+
+// outputWriters returns the writers which need to receive the stdout and
+// stderr of the remote process
+func (s *Session) outputWriters() (io.Writer, io.Writer) {
+	var stdout, stderr io.Writer = &s.stdout, &s.stderr
+	if len(s.loggers) > 0 {
+		stdout = io.MultiWriter(&s.stdout, s.loggers[0])
+		stderr = io.MultiWriter(&s.stderr, s.loggers[1])
+	}
+
+	s.outputs = []*outputFilter{{sess: s, dest: stdout}, {sess: s, dest: stderr}}
+
+	return s.outputs[0], s.outputs[1]
+}
+
+// outputFilter strips the become password prompt, if any, from the output
+// of the remote process
+type outputFilter struct {
+	sess    *Session
+	dest    io.Writer
+	pending []byte
+}
+
+func (f *outputFilter) Write(p []byte) (int, error) {
+	if f.sess.responder == nil {
+		return f.dest.Write(p)
+	}
+
+	f.sess.responder.filter(f.dest, &f.pending, p)
+
+	return len(p), nil
+}
+
+// result returns the details of the completed remote process
+func (s *Session) result() *Result {
+	return &Result{
+		Command:  s.command,
+		Stdout:   s.Stdout(),
+		Stderr:   s.Stderr(),
+		Duration: time.Since(s.started),
+	}
+}
+
+// flushOutput forwards the output held back while looking for the become
+// password prompt and logs any remaining output of the remote process
+func (s *Session) flushOutput() {
+	for _, f := range s.outputs {
+		f.dest.Write(f.pending)
+		f.pending = nil
+	}
+
+	for _, l := range s.loggers {
+		l.Flush()
+	}
+}
+
 // close closes the current session
 func (s *Session) close() error {
 	if s.sigintHandlerQuitChan != nil {
@@ -56,7 +149,7 @@ func (s *Session) close() error {
 		return fmt.Errorf("failed to close stdin: %s", err)
 	}
 
-	err = s.sshSess.Close()
+	err = s.proc.Close()
 	if err != nil {
 		return fmt.Errorf("failed to close session: %s", err)
 	}
@@ -64,49 +157,25 @@ func (s *Session) close() error {
 	return nil
 }
 
-// newSession creates a new session
-func newSession(ctx context.Context, client *ssh.Client, withTerminal bool) (*Session, error) {
-	sshSess, err := client.NewSession()
-	if err != nil {
-		client.Close()
-		return nil, fmt.Errorf("failed to initialise session: %s", err)
-	}
-
-	stdin, err := sshSess.StdinPipe()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get the session stdin pipe: %s", err)
-	}
-
-	// Request a pseudo terminal for forwarding signals to the remote process
-	// NB: scp misbehaves when a pseudoterminal is attached, but we need one
-	// to cancel other commands...
-	if withTerminal {
-		err = sshSess.RequestPty("xterm", 80, 40,
-			ssh.TerminalModes{
-				ssh.ECHO:          0,     // disable echoing
-				ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
-				ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
-			},
-		)
-		if err != nil {
-			return nil, fmt.Errorf("failed to setup the pseudo terminal: %s", err)
-		}
+// newSession creates a new session for the given process. When ctx is
+// cancelled, interrupt (if not nil) is called and stdin gets closed. In
+// verbose mode, the output of the process is also logged line by line,
+// prefixed with the given address.
+func newSession(ctx context.Context, proc process, stdin io.WriteCloser, interrupt func() error, verbose bool, address string) *Session {
+	quitChan := make(chan struct{})
+	sess := Session{proc: proc, stdin: stdin, interrupt: interrupt, sigintHandlerQuitChan: quitChan}
+	if verbose {
+		sess.loggers = []*lineLogger{{address: address}, {address: address}}
 	}
 
-	// If requested, send SIGINT to the remote process and close the session
-	quitChan := make(chan struct{})
-	sess := Session{sshSess: sshSess, stdin: stdin, sigintHandlerQuitChan: quitChan}
+	// If requested, interrupt the remote process and close the session
 	go func() {
 		select {
 		case <-ctx.Done():
-			if withTerminal {
-				// Looks like ssh.SIGINT is not supported by OpenSSH. What a bummer :(
-				// https://github.com/golang/go/issues/4115#issuecomment-66070418
-				// https://github.com/golang/go/issues/16597
-				// err := sshSess.Signal(ssh.SIGINT)
-				_, err := stdin.Write([]byte("\x03"))
+			if interrupt != nil {
+				err := interrupt()
 				if err != nil && err != io.EOF {
-					log.Warnf("Failed to send SIGINT to the remote process: %s", err)
+					log.Warnf("Failed to interrupt the remote process: %s", err)
 				}
 			}
 			err := sess.CloseStdin()
@@ -115,99 +184,94 @@ func newSession(ctx context.Context, client *ssh.Client, withTerminal bool) (*Se
 			}
 			err = ctx.Err()
 			if err == context.DeadlineExceeded {
-				log.Warnf("Context deadline exceeeded on server: %s", client.RemoteAddr())
+				log.Warnf("Context deadline exceeeded on server: %s", address)
 			}
 		case <-quitChan:
 			// Stop the signal handler when the task completes
 		}
 	}()
 
-	return &sess, nil
+	return &sess
 }
 
-type ExecCallbackFunc func(*Session) (error, *errgroup.Group)
-
-type Connection interface {
-	Close() error
-	Exec(context.Context, bool, ExecCallbackFunc) error
-	GetAddress() string
-	GetHost() string
-	// TODO: Redesign this to avoid mutating state
-	SetError(error)
-}
-
-type connection struct {
-	Server *inventory.Server
-	client *ssh.Client
-}
-
-func (conn *connection) Close() error {
-	return conn.client.Close()
-}
-
-func (conn *connection) Exec(ctx context.Context, withTerminal bool, fn ExecCallbackFunc) error {
-	sess, err := newSession(ctx, conn.client, withTerminal)
-	if err != nil {
-		return fmt.Errorf("failed to create new session: %s", err)
-	}
+// execSession runs the process started by fn in the given session and waits
+// for it to complete. It returns an *ExitError if the process fails and the
+// context error if ctx is cancelled.
+func execSession(ctx context.Context, sess *Session, fn ExecCallbackFunc, address string) (*Result, error) {
 	// TODO: Log error
 	defer sess.close()
 
 	err, errGroup := fn(sess)
 	if err != nil {
-		return fmt.Errorf("failed to start the ssh command: %s", err)
+		return nil, fmt.Errorf("failed to start the command: %s", err)
 	}
 
 	// Wait for the session to finish running
 	err = sess.wait()
+	sess.flushOutput()
+	res := sess.result()
 	if err != nil {
 		// Check the async operation (if there is any) for the error
 		// cause before returning
-		err = fmt.Errorf("failed ssh command: %s", err)
+		err = newWaitError(res, err)
+	}
+
+	if sess.responder != nil && sess.responder.err != nil {
+		err = fmt.Errorf("failed to become %q: %s", sess.become.user(), sess.responder.err)
 	}
 
 	if errGroup != nil {
 		asyncErr := errGroup.Wait()
 		if asyncErr != nil {
-			err = fmt.Errorf("%s: failed async ssh operation: %s", err, asyncErr)
+			if err != nil {
+				err = fmt.Errorf("%s: failed async operation: %s", err, asyncErr)
+			} else {
+				err = fmt.Errorf("failed async operation: %s", asyncErr)
+			}
 		}
 	}
 
-	if err != nil {
-		return err
-	}
+	log.Debugf(
+		"Command %q on %q exited with status %d after %s",
+		res.Command, address, res.ExitStatus, res.Duration,
+	)
 
-	// Make sure we always return some error when the command is cancelled
-	return ctx.Err()
-}
+	// Make sure we always return the context error when the command is
+	// cancelled, so callers can tell it apart from a failed command
+	if ctx.Err() != nil {
+		return res, ctx.Err()
+	}
 
-func (conn *connection) GetAddress() string {
-	return conn.Server.GetAddress()
+	return res, err
 }
 
-func (conn *connection) GetHost() string {
-	return conn.Server.Host
-}
+type ExecCallbackFunc func(*Session) (error, *errgroup.Group)
 
-func (conn *connection) SetError(err error) {
-	conn.Server.SetError(err)
+type Connection interface {
+	Close() error
+	// Exec runs a process, which is started by the callback, and waits for
+	// it to complete. The bool flag requests a pseudo terminal.
+	Exec(context.Context, bool, ExecCallbackFunc) (*Result, error)
+	// CopyFile writes the contents of the reader, which has the given size,
+	// to the destination path with the given mode
+	CopyFile(ctx context.Context, src io.Reader, size int64, dest, mode string) error
+	GetAddress() string
+	GetHost() string
+	// TODO: Redesign this to avoid mutating state
+	SetError(error)
 }
 
-func NewConnection(server *inventory.Server, timeout time.Duration) (Connection, error) {
-	sshConfig := &ssh.ClientConfig{
-		User: server.Username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(server.Password),
-		},
-		Timeout: timeout,
-		// TODO: Be stricter about security
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+// NewConnection connects to the given server using the transport selected
+// in the inventory
+func NewConnection(server *inventory.Server, conf config.Config) (Connection, error) {
+	switch server.Connection {
+	case "", inventory.ConnectionSSH:
+		return newSSHConnection(server, conf)
+	case inventory.ConnectionLocal:
+		return newLocalConnection(server, conf), nil
+	case inventory.ConnectionDocker:
+		return newDockerConnection(server, conf)
+	default:
+		return nil, fmt.Errorf("unrecognised connection type: %q", server.Connection)
 	}
-
-	client, err := ssh.Dial("tcp", server.GetAddress(), sshConfig)
-	if err != nil {
-		return nil, fmt.Errorf("dial error: %s", err)
-	}
-
-	return &connection{Server: server, client: client}, nil
 }
@@ -2,15 +2,26 @@ package transport
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gliderlabs/ssh"
+	"github.com/mihaitodor/wormhole/config"
 	"github.com/mihaitodor/wormhole/inventory"
 	. "github.com/smartystreets/goconvey/convey"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -40,6 +51,11 @@ func Test_NewConnection(t *testing.T) {
 		server, err := initServer(listener.Addr().String())
 		So(err, ShouldBeNil)
 
+		conf := config.Config{
+			ConnectTimeout:  500 * time.Millisecond,
+			HostKeyChecking: config.HostKeyCheckingOff,
+		}
+
 		dummySshCommand := "cowsay"
 		sshHandlerDone := make(chan struct{})
 		dummySshServer := ssh.Server{
@@ -52,9 +68,15 @@ func Test_NewConnection(t *testing.T) {
 		}
 
 		// Start the dummySshServer in the background
+		listenerClosed := make(chan struct{})
 		go func() {
 			err := dummySshServer.Serve(listener)
-			c.So(err, ShouldEqual, ssh.ErrServerClosed)
+			select {
+			case <-listenerClosed:
+				// Serve fails with a different error if we close the listener
+			default:
+				c.So(err, ShouldEqual, ssh.ErrServerClosed)
+			}
 		}()
 		Reset(func() {
 			So(dummySshServer.Shutdown(context.Background()), ShouldBeNil)
@@ -65,7 +87,7 @@ func Test_NewConnection(t *testing.T) {
 			connReady := make(chan struct{})
 			go func() {
 				var err error
-				conn, err = NewConnection(server, 500*time.Millisecond)
+				conn, err = NewConnection(server, conf)
 				c.So(err, ShouldBeNil)
 
 				close(connReady)
@@ -94,10 +116,12 @@ func Test_NewConnection(t *testing.T) {
 			})
 
 			Convey("and execute a command on the server", func() {
-				err := conn.Exec(context.Background(), false, func(sess *Session) (error, *errgroup.Group) {
+				res, err := conn.Exec(context.Background(), false, func(sess *Session) (error, *errgroup.Group) {
 					return sess.Start(dummySshCommand), nil
 				})
 				So(err, ShouldBeNil)
+				So(res.Command, ShouldEqual, dummySshCommand)
+				So(res.ExitStatus, ShouldEqual, 0)
 
 				var timeout time.Time
 				select {
@@ -110,11 +134,235 @@ func Test_NewConnection(t *testing.T) {
 
 		Convey("should fail to connect on a closed port", func() {
 			// Close the underlying listener of dummySshServer
+			close(listenerClosed)
 			err := listener.Close()
 			So(err, ShouldBeNil)
 
-			_, err = NewConnection(server, 500*time.Millisecond)
+			_, err = NewConnection(server, conf)
 			So(err.Error(), ShouldContainSubstring, "connect: connection refused")
 		})
 	})
 }
+
+func writePrivateKey(c C, passphrase string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.So(err, ShouldBeNil)
+
+	block := &pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}
+	if passphrase != "" {
+		block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, []byte(passphrase), x509.PEMCipherAES256)
+		c.So(err, ShouldBeNil)
+	}
+
+	f, err := ioutil.TempFile("", "wormhole_key")
+	c.So(err, ShouldBeNil)
+	defer f.Close()
+
+	c.So(pem.Encode(f, block), ShouldBeNil)
+
+	return f.Name()
+}
+
+func Test_authMethods(t *testing.T) {
+	Convey("authMethods()", t, func(c C) {
+		sshAuthSock := os.Getenv("SSH_AUTH_SOCK")
+		So(os.Unsetenv("SSH_AUTH_SOCK"), ShouldBeNil)
+		Reset(func() {
+			So(os.Setenv("SSH_AUTH_SOCK", sshAuthSock), ShouldBeNil)
+		})
+
+		Convey("should fall back to an empty password", func() {
+			methods, agentConn, err := authMethods(&inventory.Server{})
+			So(err, ShouldBeNil)
+			So(agentConn, ShouldBeNil)
+			So(methods, ShouldHaveLength, 1)
+		})
+
+		Convey("should use both the private key and the password", func() {
+			keyFile := writePrivateKey(c, "")
+			Reset(func() { So(os.Remove(keyFile), ShouldBeNil) })
+
+			methods, _, err := authMethods(&inventory.Server{
+				PrivateKey: keyFile,
+				Password:   "mellon",
+			})
+			So(err, ShouldBeNil)
+			So(methods, ShouldHaveLength, 2)
+		})
+
+		Convey("should decrypt private keys with a passphrase", func() {
+			keyFile := writePrivateKey(c, "mellon")
+			Reset(func() { So(os.Remove(keyFile), ShouldBeNil) })
+
+			_, _, err := authMethods(&inventory.Server{
+				PrivateKey: keyFile,
+				Passphrase: "mellon",
+			})
+			So(err, ShouldBeNil)
+
+			Convey("and fail when the passphrase is wrong", func() {
+				_, _, err := authMethods(&inventory.Server{
+					PrivateKey: keyFile,
+					Passphrase: "friend",
+				})
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "failed to parse private key")
+			})
+		})
+
+		Convey("should fail when the private key is missing", func() {
+			_, _, err := authMethods(&inventory.Server{PrivateKey: "/nonexistent/id_rsa"})
+			So(err.Error(), ShouldContainSubstring, "failed to read private key")
+		})
+	})
+}
+
+func newPublicKey(c C) gossh.PublicKey {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.So(err, ShouldBeNil)
+
+	publicKey, err := gossh.NewPublicKey(&key.PublicKey)
+	c.So(err, ShouldBeNil)
+
+	return publicKey
+}
+
+func Test_newHostKeyCallback(t *testing.T) {
+	Convey("newHostKeyCallback()", t, func(c C) {
+		dir, err := ioutil.TempDir("", "wormhole_known_hosts")
+		So(err, ShouldBeNil)
+		Reset(func() { So(os.RemoveAll(dir), ShouldBeNil) })
+
+		knownHostsFile := filepath.Join(dir, "known_hosts")
+		hostname := "gondor:2222"
+		remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}
+		key := newPublicKey(c)
+
+		Convey("should reject unrecognised policies", func() {
+			_, _, err := newHostKeyCallback("yolo", knownHostsFile)
+			So(err.Error(), ShouldContainSubstring, "unrecognised host key checking policy")
+		})
+
+		Convey("should accept any key when disabled", func() {
+			callback, _, err := newHostKeyCallback(config.HostKeyCheckingOff, knownHostsFile)
+			So(err, ShouldBeNil)
+			So(callback(hostname, remote, key), ShouldBeNil)
+		})
+
+		Convey("should add new hosts to known hosts in accept-new mode", func() {
+			callback, _, err := newHostKeyCallback(config.HostKeyCheckingAcceptNew, knownHostsFile)
+			So(err, ShouldBeNil)
+			So(callback(hostname, remote, key), ShouldBeNil)
+
+			contents, err := ioutil.ReadFile(knownHostsFile)
+			So(err, ShouldBeNil)
+			So(string(contents), ShouldStartWith, "[gondor]:2222 ssh-rsa ")
+
+			Convey("and then accept them in strict mode", func() {
+				callback, _, err := newHostKeyCallback(config.HostKeyCheckingStrict, knownHostsFile)
+				So(err, ShouldBeNil)
+				So(callback(hostname, remote, key), ShouldBeNil)
+			})
+
+			Convey("and then reject them if the key changes", func() {
+				callback, _, err := newHostKeyCallback(config.HostKeyCheckingAcceptNew, knownHostsFile)
+				So(err, ShouldBeNil)
+
+				otherKey := newPublicKey(c)
+				err = callback(hostname, remote, otherKey)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "host key mismatch for \"gondor:2222\"")
+				So(err.Error(), ShouldContainSubstring, gossh.FingerprintSHA256(otherKey))
+			})
+		})
+
+		Convey("should return the types of the known keys of a host", func() {
+			line := func(key gossh.PublicKey) string {
+				return knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key) + "\n"
+			}
+			So(ioutil.WriteFile(knownHostsFile, []byte(line(key)), 0600), ShouldBeNil)
+
+			_, algorithms, err := newHostKeyCallback(config.HostKeyCheckingStrict, knownHostsFile)
+			So(err, ShouldBeNil)
+			So(algorithms(hostname), ShouldResemble, []string{gossh.KeyAlgoRSA})
+			So(algorithms("rohan:22"), ShouldBeNil)
+
+			_, algorithms, err = newHostKeyCallback(config.HostKeyCheckingOff, knownHostsFile)
+			So(err, ShouldBeNil)
+			So(algorithms(hostname), ShouldBeNil)
+		})
+
+		Convey("should reject unknown hosts in strict mode", func() {
+			So(ioutil.WriteFile(knownHostsFile, nil, 0600), ShouldBeNil)
+
+			callback, _, err := newHostKeyCallback(config.HostKeyCheckingStrict, knownHostsFile)
+			So(err, ShouldBeNil)
+
+			err = callback(hostname, remote, key)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "unknown host \"gondor:2222\"")
+			So(err.Error(), ShouldContainSubstring, gossh.FingerprintSHA256(key))
+		})
+	})
+}
+
+func Test_Exec(t *testing.T) {
+	Convey("Connection.Exec()", t, func(c C) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+
+		server, err := initServer(listener.Addr().String())
+		So(err, ShouldBeNil)
+
+		dummySshServer := ssh.Server{
+			Addr: server.GetAddress(),
+			Handler: func(s ssh.Session) {
+				// Exit with the status given as the command
+				status, err := strconv.Atoi(strings.Join(s.Command(), " "))
+				c.So(err, ShouldBeNil)
+
+				_, err = s.Stderr().Write([]byte("you shall not pass\n"))
+				c.So(err, ShouldBeNil)
+				c.So(s.Exit(status), ShouldBeNil)
+			},
+		}
+		go func() {
+			_ = dummySshServer.Serve(listener)
+		}()
+
+		conn, err := NewConnection(server, config.Config{
+			ConnectTimeout:  500 * time.Millisecond,
+			HostKeyChecking: config.HostKeyCheckingOff,
+		})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			So(conn.Close(), ShouldBeNil)
+			So(dummySshServer.Shutdown(context.Background()), ShouldBeNil)
+		})
+
+		exec := func(status string) (*Result, error) {
+			return conn.Exec(context.Background(), false, func(sess *Session) (error, *errgroup.Group) {
+				return sess.Start(status), nil
+			})
+		}
+
+		Convey("should return the result of successful commands", func() {
+			res, err := exec("0")
+			So(err, ShouldBeNil)
+			So(res.ExitStatus, ShouldEqual, 0)
+			So(res.Stderr, ShouldEqual, "you shall not pass\n")
+			So(res.Duration, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("should return an ExitError for failed commands", func() {
+			res, err := exec("100")
+			So(err, ShouldHaveSameTypeAs, &ExitError{})
+			So(err.(*ExitError).Result, ShouldEqual, res)
+			So(res.ExitStatus, ShouldEqual, 100)
+			So(err.Error(), ShouldEqual, "command exited with status 100\nyou shall not pass")
+		})
+	})
+}
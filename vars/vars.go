@@ -0,0 +1,54 @@
+package vars
+
+import (
+	"context"
+	"sync"
+)
+
+// Vars maps variable names to their values
+type Vars map[string]interface{}
+
+// Merge returns the union of the given variables. When a variable is defined
+// more than once, the last definition wins.
+func Merge(all ...Vars) Vars {
+	merged := make(Vars)
+	for _, v := range all {
+		for name, value := range v {
+			merged[name] = value
+		}
+	}
+
+	return merged
+}
+
+// GatherFunc collects the facts of a host
+type GatherFunc func(context.Context) (Vars, error)
+
+// Scope holds the variables available to the actions running on a host.
+// Facts are only gathered the first time they are needed.
+type Scope struct {
+	Vars     Vars
+	gather   GatherFunc
+	once     sync.Once
+	facts    Vars
+	factsErr error
+}
+
+// NewScope creates a new scope with the given variables
+func NewScope(v Vars, gather GatherFunc) *Scope {
+	return &Scope{Vars: v, gather: gather}
+}
+
+// Facts returns the facts of the host, gathering them if needed
+func (s *Scope) Facts(ctx context.Context) (Vars, error) {
+	s.once.Do(func() {
+		if s.gather == nil {
+			s.facts = make(Vars)
+			return
+		}
+
+		s.facts, s.factsErr = s.gather(ctx)
+	})
+
+	return s.facts, s.factsErr
+}
@@ -0,0 +1,55 @@
+package vars
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Merge(t *testing.T) {
+	Convey("Merge()", t, func() {
+		Convey("should give precedence to the last definition", func() {
+			merged := Merge(Vars{"ring": "one", "bearer": "frodo"}, nil, Vars{"bearer": "sam"})
+			So(merged, ShouldResemble, Vars{"ring": "one", "bearer": "sam"})
+		})
+
+		Convey("should not modify its arguments", func() {
+			v := Vars{"ring": "one"}
+			Merge(v, Vars{"ring": "two"})
+			So(v["ring"], ShouldEqual, "one")
+		})
+	})
+}
+
+func Test_Scope(t *testing.T) {
+	Convey("Scope.Facts()", t, func() {
+		calls := 0
+		scope := NewScope(nil, func(context.Context) (Vars, error) {
+			calls++
+			return Vars{"hostname": "rivendell"}, nil
+		})
+
+		Convey("should gather the facts only once", func() {
+			So(calls, ShouldEqual, 0)
+
+			facts, err := scope.Facts(context.Background())
+			So(err, ShouldBeNil)
+			So(facts["hostname"], ShouldEqual, "rivendell")
+
+			_, err = scope.Facts(context.Background())
+			So(err, ShouldBeNil)
+			So(calls, ShouldEqual, 1)
+		})
+
+		Convey("should return the gathering error", func() {
+			scope := NewScope(nil, func(context.Context) (Vars, error) {
+				return nil, errors.New("hobbits not found")
+			})
+
+			_, err := scope.Facts(context.Background())
+			So(err.Error(), ShouldEqual, "hobbits not found")
+		})
+	})
+}
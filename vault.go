@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/mihaitodor/wormhole/config"
+	"github.com/mihaitodor/wormhole/vault"
+)
+
+// loadVault returns the vault for the password supplied via conf or nil if
+// there is none. If required, the password is prompted for when it's not
+// supplied and, if confirm is set, it has to be entered twice.
+func loadVault(conf config.Config, required, confirm bool) (*vault.Vault, error) {
+	if conf.VaultPasswordFile != "" {
+		return vault.NewFromFile(conf.VaultPasswordFile)
+	}
+
+	if !conf.AskVaultPass && !required {
+		return nil, nil
+	}
+
+	return promptVault("Vault password: ", confirm)
+}
+
+func promptVault(prompt string, confirm bool) (*vault.Vault, error) {
+	password, err := config.PromptPassword(prompt)
+	if err != nil {
+		return nil, err
+	}
+	if password == "" {
+		return nil, errors.New("the vault password can't be empty")
+	}
+
+	if confirm {
+		confirmation, err := config.PromptPassword("Confirm " + strings.ToLower(prompt[:1]) + prompt[1:])
+		if err != nil {
+			return nil, err
+		}
+		if confirmation != password {
+			return nil, errors.New("the vault passwords don't match")
+		}
+	}
+
+	return vault.New(password), nil
+}
+
+// runVault runs the vault command selected in conf
+func runVault(conf config.Config) error {
+	encrypting := conf.Command == config.CommandVaultEncrypt || conf.Command == config.CommandVaultEncryptString
+	v, err := loadVault(conf, true, encrypting)
+	if err != nil {
+		return err
+	}
+
+	switch conf.Command {
+	case config.CommandVaultEncrypt:
+		return rewriteFiles(conf.Vault.Files, func(data []byte) ([]byte, error) {
+			if vault.IsEncrypted(data) {
+				return nil, errors.New("input is already vault encrypted data")
+			}
+			return v.Encrypt(data)
+		})
+	case config.CommandVaultEncryptString:
+		value, err := v.EncryptValue(conf.Vault.Value)
+		if err != nil {
+			return err
+		}
+		if conf.Vault.Name != "" {
+			value = conf.Vault.Name + ": " + value
+		}
+		fmt.Print(value)
+		return nil
+	case config.CommandVaultDecrypt:
+		return rewriteFiles(conf.Vault.Files, func(data []byte) ([]byte, error) {
+			if !vault.IsEncrypted(data) && !vault.HasInlineValues(data) {
+				return nil, errors.New("input is not vault encrypted data")
+			}
+			return v.DecryptYAML(data)
+		})
+	case config.CommandVaultEdit:
+		return editVaultFile(v, conf.Vault.Files[0])
+	case config.CommandVaultRekey:
+		newVault, err := loadNewVault(conf)
+		if err != nil {
+			return err
+		}
+		return rewriteFiles(conf.Vault.Files, func(data []byte) ([]byte, error) {
+			return v.Rekey(data, newVault)
+		})
+	default:
+		return fmt.Errorf("unrecognised command %q", conf.Command)
+	}
+}
+
+func loadNewVault(conf config.Config) (*vault.Vault, error) {
+	if conf.Vault.NewPasswordFile != "" {
+		return vault.NewFromFile(conf.Vault.NewPasswordFile)
+	}
+
+	return promptVault("New vault password: ", true)
+}
+
+// rewriteFiles replaces the contents of each file with the result of fn. All
+// files are processed before any of them is written, so they are either all
+// rewritten or none of them is.
+func rewriteFiles(files []string, fn func([]byte) ([]byte, error)) error {
+	contents := make([][]byte, len(files))
+	for i, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %q: %s", file, err)
+		}
+
+		contents[i], err = fn(data)
+		if err != nil {
+			return fmt.Errorf("failed to process %q: %s", file, err)
+		}
+	}
+
+	for i, file := range files {
+		err := writeFile(file, contents[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeFile replaces the contents of an existing file and keeps its mode
+func writeFile(file string, data []byte) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return fmt.Errorf("failed to write %q: %s", file, err)
+	}
+
+	err = ioutil.WriteFile(file, data, info.Mode())
+	if err != nil {
+		return fmt.Errorf("failed to write %q: %s", file, err)
+	}
+
+	return nil
+}
+
+// editVaultFile decrypts the file into a temporary file, opens it in $EDITOR
+// (default vi) and encrypts the result back into the file if it changed
+func editVaultFile(v *vault.Vault, file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read %q: %s", file, err)
+	}
+
+	plaintext, err := v.Decrypt(data)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %q: %s", file, err)
+	}
+
+	tmp, err := ioutil.TempFile("", "wormhole-vault-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(plaintext)
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write temporary file: %s", err)
+	}
+
+	editor := strings.Fields(os.Getenv("EDITOR"))
+	if len(editor) == 0 {
+		editor = []string{"vi"}
+	}
+
+	cmd := exec.Command(editor[0], append(editor[1:], tmp.Name())...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("failed to run editor: %s", err)
+	}
+
+	edited, err := ioutil.ReadFile(tmp.Name())
+	if err != nil {
+		return fmt.Errorf("failed to read temporary file: %s", err)
+	}
+
+	if bytes.Equal(edited, plaintext) {
+		return nil
+	}
+
+	encrypted, err := v.Encrypt(edited)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(file, encrypted)
+}
@@ -0,0 +1,256 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Header is the first line of encrypted data
+const Header = "$WORMHOLE_VAULT;1.0;AES256-GCM"
+
+const (
+	saltSize  = 16
+	nonceSize = 12
+	keySize   = 32
+	lineWidth = 76
+)
+
+// inlineValue matches the `!vault |` block scalars which hold encrypted
+// values inside Yaml files
+var inlineValue = regexp.MustCompile(
+	`(?m)!vault[ \t]*\|[ \t]*\r?\n([ \t]+)(` + regexp.QuoteMeta(Header) + `\r?$(?:\n[ \t]+[A-Za-z0-9+/=]+\r?$)*)`,
+)
+
+// ErrMissingPassword is returned when encrypted data is found, but no vault
+// password was supplied
+var ErrMissingPassword = errors.New("found vault encrypted data, but no vault password was supplied")
+
+// Vault encrypts and decrypts data with a key derived from a password via
+// scrypt. The data is encrypted with AES-256-GCM, which also authenticates
+// it, so a wrong password or tampered data are detected on decryption.
+type Vault struct {
+	password []byte
+}
+
+// New creates a vault which uses the given password
+func New(password string) *Vault {
+	return &Vault{password: []byte(password)}
+}
+
+// NewFromFile creates a vault which uses the password stored in the given
+// file. Trailing newlines are ignored.
+func NewFromFile(passwordFile string) (*Vault, error) {
+	password, err := ioutil.ReadFile(passwordFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vault password file: %s", err)
+	}
+
+	return New(strings.TrimRight(string(password), "\r\n")), nil
+}
+
+// IsEncrypted checks if data was encrypted as a whole by the vault
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte(Header))
+}
+
+// HasInlineValues checks if data contains encrypted `!vault` values
+func HasInlineValues(data []byte) bool {
+	return inlineValue.Match(data)
+}
+
+// Encrypt returns the encrypted data, consisting of the header followed by
+// the base64 encoded salt, nonce and ciphertext
+func (v *Vault) Encrypt(plaintext []byte) ([]byte, error) {
+	if v == nil {
+		return nil, errors.New("no vault password was supplied")
+	}
+
+	salt := make([]byte, saltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %s", err)
+	}
+
+	gcm, err := v.cipher(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, nonceSize)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %s", err)
+	}
+
+	payload := append(salt, nonce...)
+	payload = gcm.Seal(payload, nonce, plaintext, []byte(Header))
+	encoded := base64.StdEncoding.EncodeToString(payload)
+
+	var buf bytes.Buffer
+	buf.WriteString(Header + "\n")
+	for len(encoded) > 0 {
+		n := lineWidth
+		if n > len(encoded) {
+			n = len(encoded)
+		}
+		buf.WriteString(encoded[:n] + "\n")
+		encoded = encoded[n:]
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decrypt returns the plaintext of data encrypted by Encrypt
+func (v *Vault) Decrypt(data []byte) ([]byte, error) {
+	if v == nil {
+		return nil, ErrMissingPassword
+	}
+
+	lines := strings.Fields(string(data))
+	if len(lines) < 2 || lines[0] != Header {
+		return nil, errors.New("input is not vault encrypted data")
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(strings.Join(lines[1:], ""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode vault data: %s", err)
+	}
+	if len(payload) < saltSize+nonceSize {
+		return nil, errors.New("vault data is too short")
+	}
+
+	gcm, err := v.cipher(payload[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := gcm.Open(nil, payload[saltSize:saltSize+nonceSize], payload[saltSize+nonceSize:], []byte(Header))
+	if err != nil {
+		return nil, errors.New("failed to decrypt vault data: wrong password or corrupted data")
+	}
+
+	return plaintext, nil
+}
+
+// EncryptValue returns a `!vault` block scalar holding the encrypted value,
+// which can be used as a value in Yaml files
+func (v *Vault) EncryptValue(value string) (string, error) {
+	encrypted, err := v.Encrypt([]byte(value))
+	if err != nil {
+		return "", err
+	}
+
+	return "!vault |\n" + indent(encrypted, "  "), nil
+}
+
+// DecryptYAML returns the plaintext of Yaml files which were encrypted as a
+// whole or which contain `!vault` values. The encrypted values are replaced
+// with quoted strings. Data without encrypted contents is returned as is.
+func (v *Vault) DecryptYAML(data []byte) ([]byte, error) {
+	if IsEncrypted(data) {
+		return v.Decrypt(data)
+	}
+
+	return v.replaceInlineValues(data, func(match []byte, plaintext []byte) ([]byte, error) {
+		quoted, err := json.Marshal(string(plaintext))
+		if err != nil {
+			return nil, err
+		}
+
+		return quoted, nil
+	})
+}
+
+// Rekey reencrypts data, which is either encrypted as a whole or contains
+// `!vault` values, with the password of newVault
+func (v *Vault) Rekey(data []byte, newVault *Vault) ([]byte, error) {
+	if IsEncrypted(data) {
+		plaintext, err := v.Decrypt(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return newVault.Encrypt(plaintext)
+	}
+
+	if !HasInlineValues(data) {
+		return nil, errors.New("input is not vault encrypted data")
+	}
+
+	return v.replaceInlineValues(data, func(match []byte, plaintext []byte) ([]byte, error) {
+		encrypted, err := newVault.Encrypt(plaintext)
+		if err != nil {
+			return nil, err
+		}
+
+		prefix := inlineValue.FindSubmatch(match)[1]
+		return []byte("!vault |\n" + strings.TrimRight(indent(encrypted, string(prefix)), "\n")), nil
+	})
+}
+
+// replaceInlineValues replaces each `!vault` value in data with the result
+// of fn, which receives the decrypted value
+func (v *Vault) replaceInlineValues(data []byte, fn func(match []byte, plaintext []byte) ([]byte, error)) ([]byte, error) {
+	var replaceErr error
+	replaced := inlineValue.ReplaceAllFunc(data, func(match []byte) []byte {
+		if replaceErr != nil {
+			return match
+		}
+
+		plaintext, err := v.Decrypt(inlineValue.FindSubmatch(match)[2])
+		if err != nil {
+			replaceErr = err
+			return match
+		}
+
+		replacement, err := fn(match, plaintext)
+		if err != nil {
+			replaceErr = err
+			return match
+		}
+
+		return replacement
+	})
+	if replaceErr != nil {
+		return nil, replaceErr
+	}
+
+	return replaced, nil
+}
+
+func (v *Vault) cipher(salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(v.password, salt, 1<<15, 8, 1, keySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive vault key: %s", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vault cipher: %s", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func indent(text []byte, prefix string) string {
+	lines := strings.SplitAfter(string(text), "\n")
+	var buf strings.Builder
+	for _, line := range lines {
+		if line != "" {
+			buf.WriteString(prefix + line)
+		}
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,134 @@
+package vault
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func Test_Vault(t *testing.T) {
+	Convey("Vault", t, func() {
+		v := New("speak friend")
+
+		Convey("should decrypt what it encrypts", func() {
+			encrypted, err := v.Encrypt([]byte("one ring to rule them all"))
+			So(err, ShouldBeNil)
+			So(IsEncrypted(encrypted), ShouldBeTrue)
+			So(string(encrypted), ShouldNotContainSubstring, "ring")
+			for _, line := range strings.Split(strings.TrimSpace(string(encrypted)), "\n") {
+				So(len(line), ShouldBeLessThanOrEqualTo, lineWidth)
+			}
+
+			plaintext, err := v.Decrypt(encrypted)
+			So(err, ShouldBeNil)
+			So(string(plaintext), ShouldEqual, "one ring to rule them all")
+		})
+
+		Convey("should use a different salt and nonce each time", func() {
+			first, err := v.Encrypt([]byte("mellon"))
+			So(err, ShouldBeNil)
+			second, err := v.Encrypt([]byte("mellon"))
+			So(err, ShouldBeNil)
+			So(string(first), ShouldNotEqual, string(second))
+		})
+
+		Convey("should fail to decrypt with the wrong password", func() {
+			encrypted, err := v.Encrypt([]byte("mellon"))
+			So(err, ShouldBeNil)
+
+			_, err = New("friend").Decrypt(encrypted)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "wrong password or corrupted data")
+		})
+
+		Convey("should fail to decrypt tampered data", func() {
+			encrypted, err := v.Encrypt([]byte("mellon"))
+			So(err, ShouldBeNil)
+
+			lines := strings.Split(string(encrypted), "\n")
+			last := []byte(lines[1])
+			last[10] ^= 1
+			lines[1] = string(last)
+
+			_, err = v.Decrypt([]byte(strings.Join(lines, "\n")))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("should fail to decrypt data without the header", func() {
+			_, err := v.Decrypt([]byte("mellon"))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "not vault encrypted data")
+		})
+
+		Convey("should fail without a password", func() {
+			var missing *Vault
+			_, err := missing.Decrypt([]byte(Header + "\nAAAA"))
+			So(err, ShouldEqual, ErrMissingPassword)
+		})
+	})
+}
+
+func Test_DecryptYAML(t *testing.T) {
+	Convey("Vault.DecryptYAML()", t, func() {
+		v := New("speak friend")
+		value, err := v.EncryptValue("thou \"shalt\" not\npass")
+		So(err, ShouldBeNil)
+
+		data := "servers:\n  - host: mordor\n    password: " + strings.Replace(strings.TrimSuffix(value, "\n"), "\n", "\n    ", -1) + "\n    port: 4444\n"
+
+		Convey("should replace the encrypted values", func() {
+			So(HasInlineValues([]byte(data)), ShouldBeTrue)
+
+			decrypted, err := v.DecryptYAML([]byte(data))
+			So(err, ShouldBeNil)
+
+			var parsed struct {
+				Servers []struct {
+					Host     string
+					Password string
+					Port     int
+				}
+			}
+			So(yaml.Unmarshal(decrypted, &parsed), ShouldBeNil)
+			So(parsed.Servers, ShouldHaveLength, 1)
+			So(parsed.Servers[0].Password, ShouldEqual, "thou \"shalt\" not\npass")
+			So(parsed.Servers[0].Port, ShouldEqual, 4444)
+		})
+
+		Convey("should decrypt whole files", func() {
+			encrypted, err := v.Encrypt([]byte("host: mordor\n"))
+			So(err, ShouldBeNil)
+
+			decrypted, err := v.DecryptYAML(encrypted)
+			So(err, ShouldBeNil)
+			So(string(decrypted), ShouldEqual, "host: mordor\n")
+		})
+
+		Convey("should leave plaintext files unchanged without a password", func() {
+			var missing *Vault
+			decrypted, err := missing.DecryptYAML([]byte("host: mordor\n"))
+			So(err, ShouldBeNil)
+			So(string(decrypted), ShouldEqual, "host: mordor\n")
+
+			_, err = missing.DecryptYAML([]byte(data))
+			So(err, ShouldEqual, ErrMissingPassword)
+		})
+
+		Convey("should rekey the encrypted values", func() {
+			newVault := New("mellon")
+			rekeyed, err := v.Rekey([]byte(data), newVault)
+			So(err, ShouldBeNil)
+			So(string(rekeyed), ShouldContainSubstring, "    password: !vault |\n      "+Header)
+			So(string(rekeyed), ShouldEndWith, "\n    port: 4444\n")
+
+			_, err = v.DecryptYAML(rekeyed)
+			So(err, ShouldNotBeNil)
+
+			decrypted, err := newVault.DecryptYAML(rekeyed)
+			So(err, ShouldBeNil)
+			So(string(decrypted), ShouldContainSubstring, `password: "thou \"shalt\" not\npass"`)
+		})
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mihaitodor/wormhole/config"
+	"github.com/mihaitodor/wormhole/vault"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_runVault(t *testing.T) {
+	Convey("runVault()", t, func() {
+		dir, err := ioutil.TempDir("", "wormhole-vault-test-")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			So(os.RemoveAll(dir), ShouldBeNil)
+		})
+
+		write := func(name, contents string) string {
+			file := filepath.Join(dir, name)
+			So(ioutil.WriteFile(file, []byte(contents), 0640), ShouldBeNil)
+			return file
+		}
+		read := func(file string) string {
+			contents, err := ioutil.ReadFile(file)
+			So(err, ShouldBeNil)
+			return string(contents)
+		}
+
+		passwordFile := write("password", "speak friend\n")
+		secrets := write("secrets.yaml", "password: mellon\n")
+		conf := config.Config{
+			Command:           config.CommandVaultEncrypt,
+			VaultPasswordFile: passwordFile,
+			Vault:             config.VaultConfig{Files: []string{secrets}},
+		}
+
+		So(runVault(conf), ShouldBeNil)
+
+		Convey("should encrypt files in place and keep their mode", func() {
+			So(vault.IsEncrypted([]byte(read(secrets))), ShouldBeTrue)
+
+			info, err := os.Stat(secrets)
+			So(err, ShouldBeNil)
+			So(info.Mode().Perm(), ShouldEqual, os.FileMode(0640))
+
+			err = runVault(conf)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "already vault encrypted")
+		})
+
+		Convey("should decrypt files in place", func() {
+			conf.Command = config.CommandVaultDecrypt
+			So(runVault(conf), ShouldBeNil)
+			So(read(secrets), ShouldEqual, "password: mellon\n")
+		})
+
+		Convey("should rekey files", func() {
+			conf.Command = config.CommandVaultRekey
+			conf.Vault.NewPasswordFile = write("new-password", "mellon")
+			So(runVault(conf), ShouldBeNil)
+
+			plaintext, err := vault.New("mellon").Decrypt([]byte(read(secrets)))
+			So(err, ShouldBeNil)
+			So(string(plaintext), ShouldEqual, "password: mellon\n")
+		})
+
+		Convey("should edit files with $EDITOR", func() {
+			editor := write("editor.sh", "#!/bin/sh\necho 'username: gandalf' >> \"$1\"\n")
+			So(os.Chmod(editor, 0755), ShouldBeNil)
+			oldEditor := os.Getenv("EDITOR")
+			So(os.Setenv("EDITOR", editor), ShouldBeNil)
+			defer os.Setenv("EDITOR", oldEditor)
+
+			conf.Command = config.CommandVaultEdit
+			So(runVault(conf), ShouldBeNil)
+
+			plaintext, err := vault.New("speak friend").Decrypt([]byte(read(secrets)))
+			So(err, ShouldBeNil)
+			So(string(plaintext), ShouldEqual, "password: mellon\nusername: gandalf\n")
+		})
+
+		Convey("should fail with the wrong password without changing the files", func() {
+			encrypted := read(secrets)
+			conf.Command = config.CommandVaultDecrypt
+			conf.VaultPasswordFile = write("wrong-password", "mellon")
+
+			err := runVault(conf)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "wrong password")
+			So(read(secrets), ShouldEqual, encrypted)
+		})
+	})
+}
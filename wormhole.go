@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"strings"
@@ -13,69 +14,212 @@ import (
 	"github.com/mihaitodor/wormhole/inventory"
 	"github.com/mihaitodor/wormhole/playbook"
 	"github.com/mihaitodor/wormhole/transport"
+	"github.com/mihaitodor/wormhole/vars"
 	log "github.com/sirupsen/logrus"
 )
 
-func Run(ctx context.Context, conf config.Config, playbook *playbook.Playbook, inventory inventory.Inventory) {
-	for start := 0; start < len(inventory); start += conf.MaxConcurrentConnections {
-		end := start + conf.MaxConcurrentConnections
-		if end > len(inventory) {
-			end = len(inventory)
-		}
+// Run runs the playbook on the servers of the inventory in the batches set
+// by the serial setting of the playbook. The remaining batches are skipped
+// if the percentage of failed servers in a batch exceeds max_fail_percentage.
+// It returns the action stats of each server.
+func Run(ctx context.Context, conf config.Config, pb *playbook.Playbook, servers inventory.Inventory) []playbook.Stats {
+	stats := make([]playbook.Stats, len(servers))
+	remaining := stats
+	batches := pb.Serial.Batches(len(servers))
+	for i, size := range batches {
+		batch := servers[:size]
+		servers = servers[size:]
+		batchStats := remaining[:size]
+		remaining = remaining[size:]
 
-		log.Infof("Running playbook on servers: %s",
-			strings.Join(inventory[start:end].GetAllServers(nil), ", "),
-		)
+		if len(batches) > 1 {
+			log.Infof("Running batch %d of %d on %d servers", i+1, len(batches), len(batch))
+		}
 
-		// Open a ssh session to each server in the current batch
-		var connections []transport.Connection
-		for _, server := range inventory[start:end] {
-			conn, err := transport.NewConnection(server, conf.ConnectTimeout)
-			if err != nil {
-				err = fmt.Errorf("Failed to connect to server %q: %s", server.GetAddress(), err)
-				server.SetError(err)
-				log.Warn(err)
-				continue
-			}
+		runBatch(ctx, conf, pb, batch, batchStats)
 
-			connections = append(connections, conn)
+		err := ctx.Err()
+		if err != nil {
+			log.Warnf("Skipping the rest of the hosts due to: %s", err)
+			return stats
 		}
 
-		if len(connections) == 0 {
-			continue
+		failed := len(batch.GetAllFailedServers())
+		if pb.MaxFailPercentage != nil && len(servers) > 0 &&
+			float64(failed)*100/float64(len(batch)) > *pb.MaxFailPercentage {
+			log.Errorf(
+				"Skipping the rest of the hosts: %d of %d servers failed in batch %d, which exceeds max_fail_percentage %v",
+				failed, len(batch), i+1, *pb.MaxFailPercentage,
+			)
+			return stats
 		}
+	}
 
-		var wg sync.WaitGroup
-		wg.Add(len(connections))
-		for _, conn := range connections {
-			go playbook.Run(ctx, &wg, conn, conf)
+	return stats
+}
+
+// runBatch runs the playbook on the servers via a pool of
+// MaxConcurrentConnections workers, following the strategy of the playbook
+func runBatch(ctx context.Context, conf config.Config, pb *playbook.Playbook, servers inventory.Inventory, stats []playbook.Stats) {
+	if pb.Strategy == playbook.StrategyLinear {
+		runLinear(ctx, conf, pb, servers, stats)
+		return
+	}
+
+	forEach(ctx, conf, len(servers), func(i int) {
+		runServer(ctx, conf, pb, servers[i], &stats[i])
+	})
+}
+
+// runLinear runs each task of the playbook on all the servers before
+// starting the next task. Servers on which a task fails are skipped for the
+// remaining tasks. The connection to each server of the batch stays open
+// until all the tasks are done, so MaxConcurrentConnections only limits how
+// many servers run a task at the same time.
+func runLinear(ctx context.Context, conf config.Config, pb *playbook.Playbook, servers inventory.Inventory, stats []playbook.Stats) {
+	conns := make([]transport.Connection, len(servers))
+	scopes := make([]*vars.Scope, len(servers))
+	forEach(ctx, conf, len(servers), func(i int) {
+		conns[i] = connect(conf, servers[i], &stats[i])
+		if conns[i] != nil {
+			scopes[i] = pb.NewScope(conns[i], conf, servers[i].Vars)
 		}
-		wg.Wait()
-
-		// Close ssh clients
-		for _, conn := range connections {
-			err := conn.Close()
-			if err != nil {
-				log.Warnf(
-					"Failed to close ssh connection to server %q: %s",
-					conn.GetAddress(), err,
-				)
+	})
+
+	tasksRun := make([]int, len(servers))
+	for idx := range pb.Tasks {
+		forEach(ctx, conf, len(servers), func(i int) {
+			if conns[i] == nil || servers[i].GetError() != nil {
+				return
 			}
+
+			pb.RunTask(ctx, conns[i], conf, scopes[i], idx, &stats[i])
+			tasksRun[i]++
+		})
+	}
+
+	for i, conn := range conns {
+		if conn == nil {
+			continue
 		}
 
-		for _, server := range inventory[start:end] {
-			if server.GetError() == nil {
-				server.MarkFinished()
-			}
+		closeConnection(conn)
+
+		if servers[i].GetError() == nil && tasksRun[i] == len(pb.Tasks) {
+			servers[i].MarkFinished()
 		}
+	}
+}
+
+// forEach calls fn with the indexes from 0 to n-1 via a pool of
+// MaxConcurrentConnections workers, so a new index is started as soon as
+// any of the workers is done with the previous one. It returns once all the
+// calls are done. No more calls are started after ctx is cancelled.
+func forEach(ctx context.Context, conf config.Config, n int, fn func(i int)) {
+	workers := conf.MaxConcurrentConnections
+	if workers > n {
+		workers = n
+	}
+
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				fn(i)
+			}
+		}()
+	}
 
+	for i := 0; i < n; i++ {
 		// Check if the user has requested cancellation
-		err := ctx.Err()
-		if err != nil {
-			log.Warnf("Skipping the rest of the hosts due to: %s", err)
-			return
+		if ctx.Err() != nil {
+			break
+		}
+
+		select {
+		case queue <- i:
+		case <-ctx.Done():
 		}
 	}
+	close(queue)
+	wg.Wait()
+}
+
+// runServer connects to the server and runs the playbook on it
+func runServer(ctx context.Context, conf config.Config, pb *playbook.Playbook, server *inventory.Server, stats *playbook.Stats) {
+	conn := connect(conf, server, stats)
+	if conn == nil {
+		return
+	}
+
+	pb.Run(ctx, conn, conf, server.Vars, stats)
+
+	closeConnection(conn)
+
+	if server.GetError() == nil {
+		server.MarkFinished()
+	}
+}
+
+// connect opens a connection to the server. If it fails, the error is set on
+// the server, counted in stats and nil is returned.
+func connect(conf config.Config, server *inventory.Server, stats *playbook.Stats) transport.Connection {
+	log.Infof("Running playbook on server %q", server.GetAddress())
+
+	conn, err := transport.NewConnection(server, conf)
+	if err != nil {
+		err = fmt.Errorf("Failed to connect to server %q: %s", server.GetAddress(), err)
+		server.SetError(err)
+		stats.Failed++
+		log.Warn(err)
+		return nil
+	}
+
+	return conn
+}
+
+func closeConnection(conn transport.Connection) {
+	err := conn.Close()
+	if err != nil {
+		log.Warnf(
+			"Failed to close ssh connection to server %q: %s",
+			conn.GetAddress(), err,
+		)
+	}
+}
+
+// selectServers returns the servers matching the hosts of the playbook and
+// the limit pattern from conf
+func selectServers(inv inventory.Inventory, p *playbook.Playbook, conf config.Config) (inventory.Inventory, error) {
+	servers, err := inv.Select(p.Hosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select playbook hosts: %s", err)
+	}
+
+	servers, err = servers.Select(conf.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply limit: %s", err)
+	}
+
+	return servers, nil
+}
+
+// logSummary logs the action stats of each server
+func logSummary(servers inventory.Inventory, stats []playbook.Stats) {
+	for i, server := range servers {
+		log.Infof("Summary for %q: %s", server.GetAddress(), stats[i])
+	}
+}
+
+// listHosts prints the addresses of the given servers
+func listHosts(w io.Writer, servers inventory.Inventory) {
+	fmt.Fprintf(w, "hosts (%d):\n", len(servers))
+	for _, address := range servers.GetAllServers(nil) {
+		fmt.Fprintf(w, "  %s\n", address)
+	}
 }
 
 func InitGracefulStop() context.Context {
@@ -96,19 +240,67 @@ func InitGracefulStop() context.Context {
 func main() {
 	conf := config.NewConfing()
 
-	inventory, err := inventory.NewInventory(conf.Inventory)
+	if conf.Command != config.CommandRun {
+		err := runVault(conf)
+		if err != nil {
+			log.Fatalf("Failed to run %q: %s", conf.Command, err)
+		}
+		return
+	}
+
+	v, err := loadVault(conf, false, false)
+	if err != nil {
+		log.Fatalf("Failed to load vault password: %s", err)
+	}
+
+	inv, err := inventory.NewInventory(conf.Inventory, v)
 	if err != nil {
 		log.Fatalf("Failed to load inventory: %s", err)
 	}
 
-	playbook, err := playbook.NewPlaybook(conf.Playbook)
+	playbook, err := playbook.NewPlaybook(conf.Playbook, v)
 	if err != nil {
 		log.Fatalf("Failed to load playbook: %s", err)
 	}
 
+	inventory, err := selectServers(inv, playbook, conf)
+	if err != nil {
+		log.Fatalf("Failed to select hosts: %s", err)
+	}
+
+	if conf.ListHosts {
+		listHosts(os.Stdout, inventory)
+		return
+	}
+
+	if len(inventory) == 0 {
+		log.Warn("No hosts matched")
+	}
+
+	if conf.AskPass {
+		password, err := config.PromptPassword("SSH password: ")
+		if err != nil {
+			log.Fatalf("Failed to read password: %s", err)
+		}
+		inventory.SetDefaultPassword(password)
+	}
+
+	// Read the credentials before connecting, so their sources are only
+	// used once, even if many servers share them
+	err = inventory.ResolveCredentials()
+	if err != nil {
+		log.Fatalf("Failed to resolve credentials: %s", err)
+	}
+
+	if conf.Check {
+		log.Info("Running in check mode, so nothing will be changed")
+	}
+
 	ctx := InitGracefulStop()
 
-	Run(ctx, conf, playbook, inventory)
+	stats := Run(ctx, conf, playbook, inventory)
+
+	logSummary(inventory, stats)
 
 	completed := inventory.GetAllCompletedServers()
 	if len(completed) > 0 {
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mihaitodor/wormhole/actions"
+	"github.com/mihaitodor/wormhole/config"
+	"github.com/mihaitodor/wormhole/inventory"
+	"github.com/mihaitodor/wormhole/playbook"
+	"github.com/mihaitodor/wormhole/transport/sshtest"
+	"github.com/mihaitodor/wormhole/vars"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Run(t *testing.T) {
+	Convey("Run()", t, func() {
+		server, err := sshtest.NewServer("samwise", "mellon")
+		So(err, ShouldBeNil)
+		var output bytes.Buffer
+		log.SetOutput(&output)
+		Reset(func() {
+			log.SetOutput(os.Stderr)
+			So(server.Close(), ShouldBeNil)
+		})
+
+		action, err := actions.UnmarshalAction("shell", "echo po-tay-toes")
+		So(err, ShouldBeNil)
+		pb := &playbook.Playbook{
+			Tasks: []playbook.Task{{Name: "Boil them", Actions: []actions.Action{action}}},
+		}
+
+		conf := config.Config{
+			ConnectTimeout:           500 * time.Millisecond,
+			ExecTimeout:              5 * time.Second,
+			MaxConcurrentConnections: 2,
+			HostKeyChecking:          config.HostKeyCheckingOff,
+		}
+
+		inv := inventory.Inventory{server.Inventory(), server.Inventory(), server.Inventory()}
+
+		Convey("should run the playbook on all servers", func() {
+			stats := Run(context.Background(), conf, pb, inv)
+			So(stats, ShouldResemble, []playbook.Stats{{Changed: 1}, {Changed: 1}, {Changed: 1}})
+			So(inv.GetAllCompletedServers(), ShouldHaveLength, 3)
+			So(server.Commands(), ShouldHaveLength, 3)
+			So(strings.Count(output.String(), "Running playbook on server"), ShouldEqual, 3)
+		})
+
+		Convey("should start the next server as soon as a slot frees", func() {
+			action, err := actions.UnmarshalAction("shell", "{{ command }}")
+			So(err, ShouldBeNil)
+			pb.Tasks[0].Actions = []actions.Action{action}
+			// The first server waits for the third one, which can only start
+			// once the second one frees its slot
+			inv[0].Vars = vars.Vars{"command": "for i in $(seq 40); do [ -f third ] && break; sleep 0.1; done; echo first >> order"}
+			inv[1].Vars = vars.Vars{"command": "true"}
+			inv[2].Vars = vars.Vars{"command": "touch third; echo third >> order"}
+
+			Run(context.Background(), conf, pb, inv)
+			So(inv.GetAllCompletedServers(), ShouldHaveLength, 3)
+			order, err := ioutil.ReadFile(filepath.Join(server.Root, "order"))
+			So(err, ShouldBeNil)
+			So(string(order), ShouldEqual, "third\nfirst\n")
+		})
+
+		Convey("should carry on when a server is unreachable", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			unreachable := &inventory.Server{Host: "127.0.0.1", Port: uint(listener.Addr().(*net.TCPAddr).Port)}
+			So(listener.Close(), ShouldBeNil)
+			inv[1] = unreachable
+
+			stats := Run(context.Background(), conf, pb, inv)
+			So(stats[1], ShouldResemble, playbook.Stats{Failed: 1})
+			So(inv.GetAllCompletedServers(), ShouldHaveLength, 2)
+			So(inv.GetAllFailedServers(), ShouldResemble, []string{unreachable.GetAddress()})
+			So(unreachable.GetError().Error(), ShouldContainSubstring, "connection refused")
+		})
+
+		Convey("should mark failed playbooks", func() {
+			action, err := actions.UnmarshalAction("shell", "exit 1")
+			So(err, ShouldBeNil)
+			pb.Tasks[0].Actions = []actions.Action{action}
+
+			Run(context.Background(), conf, pb, inv)
+			So(inv.GetAllFailedServers(), ShouldHaveLength, 3)
+			So(inv.GetAllCompletedServers(), ShouldBeEmpty)
+		})
+
+		Convey("should run the servers in serial batches", func() {
+			pb.Serial = playbook.Serial{"1", "50%"}
+
+			Run(context.Background(), conf, pb, inv)
+			So(inv.GetAllCompletedServers(), ShouldHaveLength, 3)
+			So(output.String(), ShouldContainSubstring, "Running batch 1 of 3 on 1 servers")
+			So(output.String(), ShouldContainSubstring, "Running batch 3 of 3 on 1 servers")
+		})
+
+		Convey("should skip the remaining batches when too many servers fail", func() {
+			action, err := actions.UnmarshalAction("shell", "exit 1")
+			So(err, ShouldBeNil)
+			pb.Tasks[0].Actions = []actions.Action{action}
+			pb.Serial = playbook.Serial{"1"}
+			maxFailPercentage := 0.0
+			pb.MaxFailPercentage = &maxFailPercentage
+
+			Run(context.Background(), conf, pb, inv)
+			So(inv.GetAllFailedServers(), ShouldHaveLength, 1)
+			So(inv.GetAllPendingServers(), ShouldHaveLength, 2)
+			So(server.Commands(), ShouldHaveLength, 1)
+			So(output.String(), ShouldContainSubstring, "exceeds max_fail_percentage")
+		})
+
+		Convey("should run each task on all servers first with the linear strategy", func() {
+			second, err := actions.UnmarshalAction("shell", "echo second")
+			So(err, ShouldBeNil)
+			pb.Tasks = append(pb.Tasks, playbook.Task{Name: "Mash them", Actions: []actions.Action{second}})
+			pb.Strategy = playbook.StrategyLinear
+
+			Run(context.Background(), conf, pb, inv)
+			So(inv.GetAllCompletedServers(), ShouldHaveLength, 3)
+			So(server.Commands(), ShouldHaveLength, 6)
+			for i, command := range server.Commands() {
+				expected := "po-tay-toes"
+				if i >= 3 {
+					expected = "second"
+				}
+				So(command, ShouldContainSubstring, expected)
+			}
+		})
+
+		Convey("should skip the remaining tasks on failed servers with the linear strategy", func() {
+			fail, err := actions.UnmarshalAction("shell", "exit {{ code }}")
+			So(err, ShouldBeNil)
+			pb.Tasks = []playbook.Task{
+				{Name: "Boil them", Actions: []actions.Action{fail}},
+				{Name: "Mash them", Actions: []actions.Action{action}},
+			}
+			pb.Strategy = playbook.StrategyLinear
+			inv[0].Vars = vars.Vars{"code": 1}
+			inv[1].Vars = vars.Vars{"code": 0}
+			inv[2].Vars = vars.Vars{"code": 0}
+
+			Run(context.Background(), conf, pb, inv)
+			So(inv.GetAllFailedServers(), ShouldHaveLength, 1)
+			So(inv.GetAllCompletedServers(), ShouldHaveLength, 2)
+			So(strings.Count(output.String(), "Running task [2/2]"), ShouldEqual, 2)
+		})
+
+		Convey("should skip the remaining servers when cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			Run(ctx, conf, pb, inv)
+			So(inv.GetAllPendingServers(), ShouldHaveLength, 3)
+			So(server.Commands(), ShouldBeEmpty)
+			So(output.String(), ShouldContainSubstring, "Skipping the rest of the hosts")
+		})
+	})
+}
+
+func Test_selectServers(t *testing.T) {
+	Convey("selectServers()", t, func() {
+		inv := inventory.Inventory{
+			{Host: "minas-tirith"},
+			{Host: "minas-morgul"},
+			{Host: "edoras"},
+		}
+
+		Convey("should select the playbook hosts within the limit", func() {
+			servers, err := selectServers(inv, &playbook.Playbook{Hosts: "minas-*"}, config.Config{Limit: "!*morgul"})
+			So(err, ShouldBeNil)
+			So(servers, ShouldHaveLength, 1)
+			So(servers[0].Host, ShouldEqual, "minas-tirith")
+
+			var output bytes.Buffer
+			listHosts(&output, servers)
+			So(output.String(), ShouldEqual, "hosts (1):\n  minas-tirith:22\n")
+		})
+
+		Convey("should select all hosts by default", func() {
+			servers, err := selectServers(inv, &playbook.Playbook{}, config.Config{})
+			So(err, ShouldBeNil)
+			So(servers, ShouldHaveLength, 3)
+		})
+
+		Convey("should fail for invalid limits", func() {
+			_, err := selectServers(inv, &playbook.Playbook{}, config.Config{Limit: "[minas"})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "failed to apply limit")
+		})
+	})
+}